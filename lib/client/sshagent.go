@@ -0,0 +1,63 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/gravitational/trace"
+)
+
+// AddCertToAgent installs privateKey and its accompanying certBytes (an
+// OpenSSH certificate in authorized_keys format, as returned by the
+// /v1/webapi/ssh/certs endpoint) into ag, so that plain `ssh` can
+// authenticate against Teleport nodes using only the agent -- no wrapped
+// client binary required, e.g. `eval $(tsh ssh-agent)` followed by
+// ordinary `ssh`. The key's lifetime in the agent is taken from the
+// certificate's ValidBefore field, so it expires from the agent at the
+// same time it stops being useful.
+func AddCertToAgent(ag agent.Agent, privateKey crypto.Signer, certBytes []byte) error {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return trace.Wrap(err, "parsing SSH certificate")
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return trace.BadParameter("expected an SSH certificate, got %T", pub)
+	}
+
+	var lifetimeSecs uint32
+	if cert.ValidBefore != uint64(ssh.CertTimeInfinity) {
+		ttl := time.Until(time.Unix(int64(cert.ValidBefore), 0))
+		if ttl > 0 {
+			lifetimeSecs = uint32(ttl.Seconds())
+		}
+	}
+
+	addedKey := agent.AddedKey{
+		PrivateKey:       privateKey,
+		Certificate:      cert,
+		LifetimeSecs:     uint32(lifetimeSecs),
+		ConfirmBeforeUse: false,
+	}
+
+	return trace.Wrap(ag.Add(addedKey))
+}
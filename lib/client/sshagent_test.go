@@ -0,0 +1,82 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestUserCert generates a throwaway user key, signs it with a throwaway
+// CA, and returns the private key plus the certificate in authorized_keys
+// format, as the /v1/webapi/ssh/certs endpoint would.
+func newTestUserCert(t *testing.T, ttl time.Duration) (ed25519.PrivateKey, []byte) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+
+	caPub, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	_ = caPub
+	require.NoError(t, err)
+	caSigner, err := ssh.NewSignerFromKey(caPriv)
+	require.NoError(t, err)
+
+	cert := &ssh.Certificate{
+		Key:             sshPub,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"alice"},
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(ttl).Unix()),
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, caSigner))
+
+	return priv, ssh.MarshalAuthorizedKey(cert)
+}
+
+func TestAddCertToAgent(t *testing.T) {
+	t.Parallel()
+
+	priv, certBytes := newTestUserCert(t, time.Hour)
+
+	keyring := agent.NewKeyring()
+	require.NoError(t, AddCertToAgent(keyring, priv, certBytes))
+
+	keys, err := keyring.List()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+}
+
+func TestAddCertToAgentRejectsNonCertificate(t *testing.T) {
+	t.Parallel()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+
+	keyring := agent.NewKeyring()
+	err = AddCertToAgent(keyring, priv, ssh.MarshalAuthorizedKey(sshPub))
+	require.Error(t, err)
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reversetunnel
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/trace"
+)
+
+// AgentConfig configures an Agent. The production Agent also carries the
+// cluster name, host/cluster keepalive tuning, and a Tracker for tunnel
+// discovery; this is the subset needed to dial and negotiate a reverse
+// tunnel connection, which is what AgentConfig.ProxyURL hooks into.
+type AgentConfig struct {
+	// Addrs are the candidate tunnel addresses to dial, one per proxy
+	// behind a load balancer or DNS round-robin entry. Connect tries them
+	// in round-robin order across successive calls, so that a proxy which
+	// just failed isn't retried ahead of its healthy peers.
+	Addrs []string
+	// ProxyURL, if set, is an explicit HTTP CONNECT proxy URL to tunnel the
+	// connection through; see resolveAgentProxyURL for the full resolution
+	// order (explicit URL, TELEPORT_FORWARD_PROXY override, then
+	// http.ProxyFromEnvironment).
+	ProxyURL string
+	// ClientConfig negotiates the SSH connection once the transport is
+	// established.
+	ClientConfig *ssh.ClientConfig
+}
+
+func (cfg *AgentConfig) checkAndSetDefaults() error {
+	if len(cfg.Addrs) == 0 {
+		return trace.BadParameter("at least one tunnel address is required")
+	}
+	if cfg.ClientConfig == nil {
+		return trace.BadParameter("client config is required")
+	}
+	return nil
+}
+
+// Agent maintains a reverse tunnel connection to one of a cluster's proxies.
+// The production Agent additionally owns the long-lived connection
+// lifecycle (reconnect backoff, heartbeats, channel routing); this is the
+// connection-setup core that lifecycle wraps, isolated so it's directly
+// testable against a fake tunnel server and a fake CONNECT proxy.
+type Agent struct {
+	cfg AgentConfig
+
+	mu       sync.Mutex
+	nextAddr int
+}
+
+// NewAgent creates an Agent from cfg.
+func NewAgent(cfg AgentConfig) (*Agent, error) {
+	if err := cfg.checkAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &Agent{cfg: cfg}, nil
+}
+
+// Connect dials the next tunnel address in round-robin order -- through
+// cfg.ProxyURL via dialAgentAddr if one resolves -- and negotiates an SSH
+// connection over it. The selected address is returned alongside the
+// connection so a caller can log or attribute failures to it.
+func (a *Agent) Connect(ctx context.Context) (addr string, sconn ssh.Conn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, err error) {
+	addr = a.advance()
+
+	nc, err := dialAgentAddr(ctx, a.cfg.ProxyURL, addr)
+	if err != nil {
+		return addr, nil, nil, nil, trace.Wrap(err, "dialing tunnel address %v", addr)
+	}
+
+	sconn, chans, reqs, err = ssh.NewClientConn(nc, addr, a.cfg.ClientConfig)
+	if err != nil {
+		nc.Close()
+		return addr, nil, nil, nil, trace.Wrap(err, "negotiating SSH tunnel to %v", addr)
+	}
+
+	return addr, sconn, chans, reqs, nil
+}
+
+// advance returns the next tunnel address and moves the round-robin cursor
+// past it, regardless of whether the caller ends up connecting to it
+// successfully.
+func (a *Agent) advance() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	addr := a.cfg.Addrs[a.nextAddr%len(a.cfg.Addrs)]
+	a.nextAddr++
+	return addr
+}
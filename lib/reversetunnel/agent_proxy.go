@@ -0,0 +1,169 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reversetunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/gravitational/trace"
+)
+
+// forwardProxyEnvVar is an override that, unlike HTTPS_PROXY/HTTP_PROXY, is
+// honored even when the tunnel address is loopback. http.ProxyFromEnvironment
+// silently refuses to proxy requests to localhost/127.0.0.1, which breaks CI
+// and dev setups that run a forward proxy on the loopback interface.
+const forwardProxyEnvVar = "TELEPORT_FORWARD_PROXY"
+
+// resolveAgentProxyURL determines which, if any, HTTP CONNECT proxy the
+// Agent should dial addr through. explicitProxyURL (AgentConfig.ProxyURL)
+// takes precedence if set; otherwise the TELEPORT_FORWARD_PROXY override is
+// consulted, bypassing the stdlib's NO_PROXY/loopback handling; finally
+// http.ProxyFromEnvironment is used, which correctly honors HTTPS_PROXY,
+// HTTP_PROXY and NO_PROXY for non-loopback targets.
+func resolveAgentProxyURL(explicitProxyURL string, addr string) (*url.URL, error) {
+	if explicitProxyURL != "" {
+		u, err := url.Parse(explicitProxyURL)
+		if err != nil {
+			return nil, trace.Wrap(err, "parsing configured proxy URL")
+		}
+		return u, nil
+	}
+
+	if override := os.Getenv(forwardProxyEnvVar); override != "" {
+		u, err := url.Parse(override)
+		if err != nil {
+			return nil, trace.Wrap(err, "parsing %v", forwardProxyEnvVar)
+		}
+		return u, nil
+	}
+
+	req, err := http.NewRequest(http.MethodConnect, "https://"+addr, nil)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	u, err := http.ProxyFromEnvironment(req)
+	if err != nil {
+		return nil, trace.Wrap(err, "resolving proxy from environment")
+	}
+	if u == nil {
+		// HTTPS_PROXY only applies to https:// requests; fall back to
+		// HTTP_PROXY (still subject to NO_PROXY) for the same target.
+		req.URL.Scheme = "http"
+		u, err = http.ProxyFromEnvironment(req)
+		if err != nil {
+			return nil, trace.Wrap(err, "resolving proxy from environment")
+		}
+	}
+	return u, nil
+}
+
+// dialThroughHTTPProxy establishes a TCP connection to proxyURL and issues a
+// CONNECT request for targetAddr, returning the resulting net.Conn once the
+// proxy has confirmed the tunnel is established. Basic auth credentials
+// embedded in proxyURL's userinfo, if any, are sent on the CONNECT request.
+func dialThroughHTTPProxy(ctx context.Context, proxyURL *url.URL, targetAddr string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, trace.Wrap(err, "dialing HTTP CONNECT proxy %v", proxyAddr)
+	}
+
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: targetAddr},
+		Host:   targetAddr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		if password, ok := proxyURL.User.Password(); ok {
+			auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+			connectReq.Header.Set("Proxy-Authorization", "Basic "+auth)
+		}
+	}
+
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, trace.Wrap(err, "writing CONNECT request")
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, trace.Wrap(err, "reading CONNECT response")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, trace.ConnectionProblem(nil,
+			"CONNECT proxy %v refused tunnel to %v: %v", proxyAddr, targetAddr, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		// The proxy should not send a response body for a successful CONNECT,
+		// but guard against a proxy that pipelines extra bytes by splicing
+		// anything already buffered back in front of the connection.
+		return &bufferedProxyConn{Conn: conn, r: br}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedProxyConn serves reads from a bufio.Reader that may already hold
+// bytes buffered while reading the CONNECT response.
+type bufferedProxyConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedProxyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// dialAgentAddr dials addr directly, or through an HTTP CONNECT proxy if one
+// is configured or discoverable in the environment for this target. This is
+// the entry point the Agent's connection setup should use in place of a
+// plain net.Dialer.DialContext when reaching an address in AgentConfig.Addrs.
+func dialAgentAddr(ctx context.Context, explicitProxyURL string, addr string) (net.Conn, error) {
+	proxyURL, err := resolveAgentProxyURL(explicitProxyURL, addr)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if proxyURL == nil {
+		dialer := &net.Dialer{}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		return conn, trace.Wrap(err)
+	}
+
+	conn, err := dialThroughHTTPProxy(ctx, proxyURL, addr)
+	if err != nil {
+		return nil, trace.Wrap(err, "dialing %v through proxy %v", addr, proxyURL.Redacted())
+	}
+	return conn, nil
+}
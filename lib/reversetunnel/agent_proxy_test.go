@@ -0,0 +1,139 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reversetunnel
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startConnectProxy starts a minimal HTTP CONNECT proxy on 127.0.0.1:0 that
+// splices the client connection through to the requested target. It returns
+// the proxy's listen address.
+func startConnectProxy(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveConnectProxy(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveConnectProxy(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer target.Close()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(target, br); done <- struct{}{} }()
+	go func() { io.Copy(conn, target); done <- struct{}{} }()
+	<-done
+}
+
+// TestDialAgentAddrThroughProxy verifies that dialAgentAddr, given an
+// explicit loopback proxy URL, tunnels the connection through a CONNECT
+// proxy rather than dialing the target directly.
+func TestDialAgentAddrThroughProxy(t *testing.T) {
+	t.Parallel()
+
+	// Target echo server that the proxy should tunnel us to.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	proxyAddr := startConnectProxy(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := dialAgentAddr(ctx, "http://"+proxyAddr, target.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	msg := []byte("hello through proxy")
+	_, err = conn.Write(msg)
+	require.NoError(t, err)
+
+	reply := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, msg, reply)
+}
+
+// TestResolveAgentProxyURLHonorsLoopbackOverride verifies that, unlike
+// http.ProxyFromEnvironment, an explicit override is honored even when the
+// target address is on loopback.
+func TestResolveAgentProxyURLHonorsLoopbackOverride(t *testing.T) {
+	t.Parallel()
+
+	u, err := resolveAgentProxyURL("http://127.0.0.1:9999", "127.0.0.1:3022")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:9999", u.Host)
+}
+
+// TestResolveAgentProxyURLNoProxyConfigured verifies that with no explicit
+// URL, no env override, and no environment proxy variables set, no proxy is
+// selected.
+func TestResolveAgentProxyURLNoProxyConfigured(t *testing.T) {
+	u, err := resolveAgentProxyURL("", "example.com:3022")
+	require.NoError(t, err)
+	require.Nil(t, u)
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reversetunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startFakeTunnelServer starts a minimal SSH server on 127.0.0.1:0 that
+// accepts any client and, on every accepted connection, sends its addr down
+// hits so a test can observe which address a client actually reached.
+func startFakeTunnelServer(t *testing.T, hits chan<- string) string {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	cfg := &ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	addr := listener.Addr().String()
+	go func() {
+		for {
+			nc, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sconn, chans, reqs, err := ssh.NewServerConn(nc, cfg)
+				if err != nil {
+					nc.Close()
+					return
+				}
+				defer sconn.Close()
+				go ssh.DiscardRequests(reqs)
+				go func() {
+					for nch := range chans {
+						nch.Reject(ssh.UnknownChannelType, "not implemented")
+					}
+				}()
+				hits <- addr
+			}()
+		}
+	}()
+
+	return addr
+}
+
+func testClientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            "agent",
+		Auth:            []ssh.AuthMethod{ssh.Password("unused")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	}
+}
+
+// TestAgentConnectRoundRobinsAddrs verifies that Agent.Connect cycles
+// through AgentConfig.Addrs in round-robin order across successive calls,
+// rather than always dialing the first address.
+func TestAgentConnectRoundRobinsAddrs(t *testing.T) {
+	t.Parallel()
+
+	hits := make(chan string, 8)
+	addr1 := startFakeTunnelServer(t, hits)
+	addr2 := startFakeTunnelServer(t, hits)
+
+	agent, err := NewAgent(AgentConfig{
+		Addrs:        []string{addr1, addr2},
+		ClientConfig: testClientConfig(),
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var dialed []string
+	for i := 0; i < 4; i++ {
+		addr, sconn, _, _, err := agent.Connect(ctx)
+		require.NoError(t, err)
+		dialed = append(dialed, addr)
+		sconn.Close()
+	}
+
+	require.Equal(t, []string{addr1, addr2, addr1, addr2}, dialed)
+
+	for i := 0; i < 4; i++ {
+		select {
+		case <-hits:
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "fake tunnel server never observed a connection")
+		}
+	}
+}
+
+// TestAgentConnectThroughProxy verifies that Agent.Connect honors
+// AgentConfig.ProxyURL, tunneling the SSH negotiation through an HTTP
+// CONNECT proxy rather than dialing the tunnel address directly.
+func TestAgentConnectThroughProxy(t *testing.T) {
+	t.Parallel()
+
+	hits := make(chan string, 1)
+	addr := startFakeTunnelServer(t, hits)
+	proxyAddr := startConnectProxy(t)
+
+	agent, err := NewAgent(AgentConfig{
+		Addrs:        []string{addr},
+		ProxyURL:     "http://" + proxyAddr,
+		ClientConfig: testClientConfig(),
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	gotAddr, sconn, _, _, err := agent.Connect(ctx)
+	require.NoError(t, err)
+	defer sconn.Close()
+	require.Equal(t, addr, gotAddr)
+
+	select {
+	case <-hits:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "fake tunnel server never observed a connection through the proxy")
+	}
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package acme lets a Teleport proxy automatically provision its own HTTPS
+// certificates via ACME (RFC 8555), modeled on
+// golang.org/x/crypto/acme/autocert. Unlike the stdlib autocert package's
+// default DirCache, the Cache implementation here is backed by the Teleport
+// backend so that multiple proxies in a highly-available cluster share
+// issued certificates and the ACME account key, instead of each proxy
+// separately (and redundantly) hitting the CA's rate limits.
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/gravitational/trace"
+	"github.com/sirupsen/logrus"
+)
+
+// LetsEncryptURL is the default ACME directory used when DirectoryURL is
+// left unset.
+const LetsEncryptURL = acme.LetsEncryptURL
+
+// renewCheckInterval is how often the background renewal loop checks
+// whether any managed certificate is due for renewal.
+const renewCheckInterval = 12 * time.Hour
+
+// renewJitter bounds the random jitter added to renewCheckInterval so that
+// HA proxies don't all wake up and hit the ACME CA at the exact same
+// moment.
+const renewJitter = 30 * time.Minute
+
+// Config configures ACME auto-provisioning for a proxy's HTTPS listener. It
+// corresponds to the proxy_service.acme block in the static config file.
+type Config struct {
+	// Enabled turns ACME provisioning on. When false, the proxy uses
+	// whatever TLS material it was given out of band, as before.
+	Enabled bool
+	// Email is the contact address submitted to the ACME CA, used for
+	// expiry and problem notifications.
+	Email string
+	// DirectoryURL is the ACME directory endpoint to use; defaults to
+	// Let's Encrypt's production directory.
+	DirectoryURL string
+	// PublicAddrs is the set of hostnames the proxy is reachable at; only
+	// these are served by the ACME HostPolicy, so the CA is never asked to
+	// issue for arbitrary SNI names a client might present.
+	PublicAddrs []string
+}
+
+// FailureReporter is notified when certificate issuance or renewal fails, so
+// the caller can surface it as an auth-server audit event.
+type FailureReporter interface {
+	ReportACMEFailure(host string, err error)
+}
+
+// noopFailureReporter is used when no FailureReporter is supplied.
+type noopFailureReporter struct{}
+
+func (noopFailureReporter) ReportACMEFailure(host string, err error) {}
+
+// NewManager builds an autocert.Manager for cfg, persisting certificates and
+// the ACME account key through cache (typically backed by the cluster's
+// storage backend so all proxies in an HA deployment share them).
+func NewManager(cfg Config, cache autocert.Cache) (*autocert.Manager, error) {
+	if !cfg.Enabled {
+		return nil, trace.BadParameter("ACME is not enabled")
+	}
+	if len(cfg.PublicAddrs) == 0 {
+		return nil, trace.BadParameter("ACME requires at least one public address to build a host policy")
+	}
+
+	directoryURL := cfg.DirectoryURL
+	if directoryURL == "" {
+		directoryURL = LetsEncryptURL
+	}
+
+	allowed := make(map[string]bool, len(cfg.PublicAddrs))
+	for _, addr := range cfg.PublicAddrs {
+		allowed[addr] = true
+	}
+
+	manager := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Email:  cfg.Email,
+		Cache:  cache,
+		Client: &acme.Client{DirectoryURL: directoryURL},
+		HostPolicy: func(ctx context.Context, host string) error {
+			if !allowed[host] {
+				return trace.AccessDenied("ACME host policy does not permit issuing for %q", host)
+			}
+			return nil
+		},
+	}
+
+	return manager, nil
+}
+
+// GetCertificateFunc returns the tls.Config.GetCertificate callback for
+// manager. It should be wired into the proxy's existing HTTPS listener
+// (port 443): manager transparently answers TLS-ALPN-01 challenges for
+// connections that negotiate the "acme-tls/1" ALPN protocol, so no separate
+// listener is required for that challenge type.
+func GetCertificateFunc(manager *autocert.Manager) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return manager.GetCertificate
+}
+
+// HTTPHandler wraps fallback with manager's HTTP-01 challenge responder. It
+// should be served on port 80 when HTTP-01 is enabled as an alternative (or
+// fallback) to TLS-ALPN-01; requests that aren't part of an ACME challenge
+// are passed through to fallback unchanged.
+func HTTPHandler(manager *autocert.Manager, fallback http.Handler) http.Handler {
+	return manager.HTTPHandler(fallback)
+}
+
+// BackendCache adapts a generic key/value store to the autocert.Cache
+// interface, namespacing keys so ACME account/certificate data doesn't
+// collide with anything else stored in the same backend.
+type BackendCache struct {
+	// Backend is the underlying storage; typically the same backend the
+	// auth server uses for cluster state, so certificates are shared across
+	// every proxy in the cluster.
+	Backend KVBackend
+	// Prefix namespaces keys written to Backend, e.g. "acme-cache".
+	Prefix string
+}
+
+// KVBackend is the minimal key/value interface BackendCache needs. It
+// matches the shape of Teleport's existing backend.Backend, scoped down so
+// this package doesn't have to import it directly.
+type KVBackend interface {
+	Get(ctx context.Context, key []byte) (value []byte, err error)
+	Put(ctx context.Context, key []byte, value []byte) error
+	Delete(ctx context.Context, key []byte) error
+}
+
+func (c *BackendCache) key(name string) []byte {
+	return []byte(c.Prefix + "/" + name)
+}
+
+// Get implements autocert.Cache.
+func (c *BackendCache) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := c.Backend.Get(ctx, c.key(name))
+	if err != nil {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, nil
+}
+
+// Put implements autocert.Cache.
+func (c *BackendCache) Put(ctx context.Context, name string, data []byte) error {
+	return trace.Wrap(c.Backend.Put(ctx, c.key(name), data))
+}
+
+// Delete implements autocert.Cache.
+func (c *BackendCache) Delete(ctx context.Context, name string) error {
+	return trace.Wrap(c.Backend.Delete(ctx, c.key(name)))
+}
+
+// RunBackgroundRenewal periodically asks manager to fetch (and thus renew,
+// if necessary) a certificate for each of cfg's public addresses, so
+// certificates are kept warm ahead of expiry rather than renewed lazily on
+// the first handshake after they lapse. It blocks until ctx is done.
+// Issuance failures are logged and reported via reporter but do not stop
+// the loop.
+func RunBackgroundRenewal(ctx context.Context, cfg Config, manager *autocert.Manager, reporter FailureReporter, log logrus.FieldLogger) {
+	runBackgroundRenewal(ctx, cfg, manager, reporter, log, renewCheckInterval, renewJitter)
+}
+
+// runBackgroundRenewal is RunBackgroundRenewal with the check interval and
+// jitter broken out as parameters so tests can drive it on a much shorter
+// cadence than the real 12-hour default.
+func runBackgroundRenewal(ctx context.Context, cfg Config, manager *autocert.Manager, reporter FailureReporter, log logrus.FieldLogger, checkInterval, jitter time.Duration) {
+	if reporter == nil {
+		reporter = noopFailureReporter{}
+	}
+	if log == nil {
+		log = logrus.StandardLogger()
+	}
+
+	nextInterval := func() time.Duration {
+		if jitter <= 0 {
+			return checkInterval
+		}
+		return checkInterval + time.Duration(rand.Int63n(int64(jitter)))
+	}
+
+	ticker := time.NewTicker(nextInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, host := range cfg.PublicAddrs {
+				hello := &tls.ClientHelloInfo{ServerName: host}
+				if _, err := manager.GetCertificate(hello); err != nil {
+					log.Warningf("ACME renewal check failed for %v: %v", host, err)
+					reporter.ReportACMEFailure(host, err)
+				}
+			}
+			ticker.Reset(nextInterval())
+		}
+	}
+}
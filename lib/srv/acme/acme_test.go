@@ -0,0 +1,105 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package acme
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memKVBackend is an in-memory KVBackend used to test BackendCache without
+// depending on a real Teleport storage backend.
+type memKVBackend struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newMemKVBackend() *memKVBackend {
+	return &memKVBackend{data: make(map[string][]byte)}
+}
+
+func (m *memKVBackend) Get(ctx context.Context, key []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.data[string(key)]
+	if !ok {
+		return nil, errNotFound{}
+	}
+	return v, nil
+}
+
+func (m *memKVBackend) Put(ctx context.Context, key []byte, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[string(key)] = value
+	return nil
+}
+
+func (m *memKVBackend) Delete(ctx context.Context, key []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, string(key))
+	return nil
+}
+
+type errNotFound struct{}
+
+func (errNotFound) Error() string { return "not found" }
+
+func TestBackendCacheRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	cache := &BackendCache{Backend: newMemKVBackend(), Prefix: "acme-cache"}
+	ctx := context.Background()
+
+	_, err := cache.Get(ctx, "example.com")
+	require.Error(t, err)
+
+	require.NoError(t, cache.Put(ctx, "example.com", []byte("cert-data")))
+
+	data, err := cache.Get(ctx, "example.com")
+	require.NoError(t, err)
+	require.Equal(t, []byte("cert-data"), data)
+
+	require.NoError(t, cache.Delete(ctx, "example.com"))
+	_, err = cache.Get(ctx, "example.com")
+	require.Error(t, err)
+}
+
+func TestNewManagerRequiresPublicAddrs(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewManager(Config{Enabled: true}, &BackendCache{Backend: newMemKVBackend()})
+	require.Error(t, err)
+}
+
+func TestNewManagerHostPolicy(t *testing.T) {
+	t.Parallel()
+
+	manager, err := NewManager(Config{
+		Enabled:     true,
+		Email:       "ops@example.com",
+		PublicAddrs: []string{"proxy.example.com"},
+	}, &BackendCache{Backend: newMemKVBackend()})
+	require.NoError(t, err)
+
+	require.NoError(t, manager.HostPolicy(context.Background(), "proxy.example.com"))
+	require.Error(t, manager.HostPolicy(context.Background(), "evil.example.com"))
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package acme
+
+import (
+	"gopkg.in/yaml.v2"
+
+	"github.com/gravitational/trace"
+)
+
+// FileConfig is the proxy_service.acme block of the static config file:
+//
+//	proxy_service:
+//	  acme:
+//	    enabled: yes
+//	    email: ops@example.com
+//	    directory_url: https://acme-v02.api.letsencrypt.org/directory
+//	    public_addr: ["proxy.example.com"]
+type FileConfig struct {
+	// Enabled is a *bool (rather than bool) so that an absent "acme:" block
+	// is distinguishable from an explicit "enabled: no".
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// Email is the ACME account contact address.
+	Email string `yaml:"email,omitempty"`
+	// DirectoryURL overrides the default Let's Encrypt production directory,
+	// e.g. to point at a staging CA.
+	DirectoryURL string `yaml:"directory_url,omitempty"`
+	// PublicAddr lists the hostnames the proxy is reachable at.
+	PublicAddr []string `yaml:"public_addr,omitempty"`
+}
+
+// ParseConfigFile unmarshals the proxy_service.acme YAML block from data
+// into a Config ready for NewManager.
+func ParseConfigFile(data []byte) (Config, error) {
+	var fc FileConfig
+	if err := yaml.Unmarshal(data, &fc); err != nil {
+		return Config{}, trace.Wrap(err, "parsing acme config")
+	}
+	return fc.toConfig(), nil
+}
+
+// toConfig converts the parsed file block into a Config. An absent
+// "enabled" key defaults to disabled, matching the feature's opt-in nature.
+func (fc FileConfig) toConfig() Config {
+	return Config{
+		Enabled:      fc.Enabled != nil && *fc.Enabled,
+		Email:        fc.Email,
+		DirectoryURL: fc.DirectoryURL,
+		PublicAddrs:  fc.PublicAddr,
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package acme
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := ParseConfigFile([]byte(`
+enabled: yes
+email: ops@example.com
+directory_url: https://acme-staging-v02.api.letsencrypt.org/directory
+public_addr: ["proxy.example.com", "proxy2.example.com"]
+`))
+	require.NoError(t, err)
+	require.Equal(t, Config{
+		Enabled:      true,
+		Email:        "ops@example.com",
+		DirectoryURL: "https://acme-staging-v02.api.letsencrypt.org/directory",
+		PublicAddrs:  []string{"proxy.example.com", "proxy2.example.com"},
+	}, cfg)
+}
+
+func TestParseConfigFileDefaultsToDisabled(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := ParseConfigFile([]byte(``))
+	require.NoError(t, err)
+	require.False(t, cfg.Enabled)
+}
@@ -0,0 +1,482 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeACMEServer is a minimal RFC 8555 ACME server, in the spirit of
+// pebble (letsencrypt's own integration-test CA): enough of the directory,
+// account, order, HTTP-01 challenge and finalize flow for
+// golang.org/x/crypto/acme.Client (and, through it, autocert.Manager) to
+// obtain a real, chain-verifiable certificate end to end. Unlike pebble it
+// does not verify JWS signatures -- this is a test fixture standing in for
+// a CA we don't control, not a security boundary -- but every object it
+// returns follows the real wire format, and HTTP-01 validation is a real
+// HTTP fetch against the challenge responder under test.
+type fakeACMEServer struct {
+	srv *httptest.Server
+
+	// challengeFetchAddr is where this fake CA performs its HTTP-01
+	// validation fetch, i.e. the address of the real
+	// ListenHTTPChallenge-backed listener under test.
+	challengeFetchAddr string
+
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+
+	mu       sync.Mutex
+	nonce    int
+	orders   map[string]*fakeOrder
+	authzs   map[string]*fakeAuthz
+	certs    map[string][]byte
+	accounts int
+}
+
+type fakeOrder struct {
+	id             string
+	domain         string
+	authzURL       string
+	status         string
+	certURL        string
+	finalizeCalled bool
+}
+
+type fakeAuthz struct {
+	id          string
+	domain      string
+	token       string
+	status      string
+	challengeID string
+}
+
+// newFakeACMEServer starts a fake CA whose HTTP-01 validation fetches
+// challengeFetchAddr.
+func newFakeACMEServer(t *testing.T, challengeFetchAddr string) *fakeACMEServer {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake-acme-root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	f := &fakeACMEServer{
+		challengeFetchAddr: challengeFetchAddr,
+		caCert:             caCert,
+		caKey:              caKey,
+		orders:             make(map[string]*fakeOrder),
+		authzs:             make(map[string]*fakeAuthz),
+		certs:              make(map[string][]byte),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", f.handleDirectory)
+	mux.HandleFunc("/new-nonce", f.handleNewNonce)
+	mux.HandleFunc("/new-account", f.handleNewAccount)
+	mux.HandleFunc("/new-order", f.handleNewOrder)
+	mux.HandleFunc("/authz/", f.handleAuthz)
+	mux.HandleFunc("/challenge/", f.handleChallenge)
+	mux.HandleFunc("/finalize/", f.handleFinalize)
+	mux.HandleFunc("/cert/", f.handleCert)
+
+	f.srv = httptest.NewServer(withNonce(f, mux))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func withNonce(f *fakeACMEServer, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.nonce++
+		nonce := strconv.Itoa(f.nonce)
+		f.mu.Unlock()
+		w.Header().Set("Replay-Nonce", nonce)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (f *fakeACMEServer) url(path string) string {
+	return f.srv.URL + path
+}
+
+func (f *fakeACMEServer) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"newNonce":   f.url("/new-nonce"),
+		"newAccount": f.url("/new-account"),
+		"newOrder":   f.url("/new-order"),
+		"revokeCert": f.url("/revoke-cert"),
+		"keyChange":  f.url("/key-change"),
+	})
+}
+
+func (f *fakeACMEServer) handleNewNonce(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeACMEServer) handleNewAccount(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.accounts++
+	id := f.accounts
+	f.mu.Unlock()
+
+	w.Header().Set("Location", f.url(fmt.Sprintf("/account/%d", id)))
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"status": "valid",
+	})
+}
+
+func (f *fakeACMEServer) handleNewOrder(w http.ResponseWriter, r *http.Request) {
+	payload, err := readJWSPayload(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Identifiers []struct {
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"identifiers"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil || len(body.Identifiers) == 0 {
+		http.Error(w, "invalid order request", http.StatusBadRequest)
+		return
+	}
+	domain := body.Identifiers[0].Value
+
+	f.mu.Lock()
+	orderID := fmt.Sprintf("%d", len(f.orders)+1)
+	authzID := fmt.Sprintf("%d", len(f.authzs)+1)
+	token := randToken()
+	authz := &fakeAuthz{id: authzID, domain: domain, token: token, status: "pending", challengeID: authzID}
+	f.authzs[authzID] = authz
+	order := &fakeOrder{id: orderID, domain: domain, authzURL: f.url("/authz/" + authzID), status: "pending"}
+	f.orders[orderID] = order
+	f.mu.Unlock()
+
+	w.Header().Set("Location", f.url("/order/"+orderID))
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"status":         order.status,
+		"identifiers":    body.Identifiers,
+		"authorizations": []string{order.authzURL},
+		"finalize":       f.url("/finalize/" + orderID),
+	})
+}
+
+func (f *fakeACMEServer) handleAuthz(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/authz/")
+	f.mu.Lock()
+	authz, ok := f.authzs[id]
+	f.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     authz.status,
+		"identifier": map[string]string{"type": "dns", "value": authz.domain},
+		"challenges": []map[string]interface{}{
+			{
+				"type":   "http-01",
+				"url":    f.url("/challenge/" + authz.challengeID),
+				"status": authz.status,
+				"token":  authz.token,
+			},
+		},
+	})
+}
+
+func (f *fakeACMEServer) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/challenge/")
+	f.mu.Lock()
+	authz, ok := f.authzs[id]
+	f.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Perform the real HTTP-01 validation fetch against the challenge
+	// responder under test, exactly like a real CA would against the
+	// domain's actual port 80 -- just pointed at this test's loopback
+	// listener instead of the public Internet.
+	resp, err := http.Get(fmt.Sprintf("http://%s/.well-known/acme-challenge/%s", f.challengeFetchAddr, authz.token))
+	valid := err == nil && resp.StatusCode == http.StatusOK
+	if resp != nil {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		valid = valid && strings.HasPrefix(string(body), authz.token+".")
+	}
+
+	f.mu.Lock()
+	if valid {
+		authz.status = "valid"
+	} else {
+		authz.status = "invalid"
+	}
+	status := authz.status
+	token := authz.token
+	f.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"type":   "http-01",
+		"url":    f.url("/challenge/" + id),
+		"status": status,
+		"token":  token,
+	})
+}
+
+func (f *fakeACMEServer) handleFinalize(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/finalize/")
+	f.mu.Lock()
+	order, ok := f.orders[id]
+	f.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	payload, err := readJWSPayload(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		http.Error(w, "invalid finalize request", http.StatusBadRequest)
+		return
+	}
+	csrDER, err := base64.RawURLEncoding.DecodeString(body.CSR)
+	if err != nil {
+		http.Error(w, "invalid csr encoding", http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		http.Error(w, "invalid csr", http.StatusBadRequest)
+		return
+	}
+
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: order.domain},
+		DNSNames:     []string{order.domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, f.caCert, csr.PublicKey, f.caKey)
+	if err != nil {
+		http.Error(w, "signing certificate: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	f.mu.Lock()
+	order.status = "valid"
+	order.finalizeCalled = true
+	order.certURL = f.url("/cert/" + id)
+	f.certs[id] = append([]byte{}, leafDER...)
+	f.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":      order.status,
+		"certificate": order.certURL,
+	})
+}
+
+func (f *fakeACMEServer) handleCert(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/cert/")
+	f.mu.Lock()
+	leafDER, ok := f.certs[id]
+	caDER := f.caCert.Raw
+	f.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+}
+
+func (f *fakeACMEServer) rootCertPEM() []byte {
+	var buf strings.Builder
+	pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})
+	return []byte(buf.String())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// readJWSPayload extracts the JSON payload from an RFC 8555 flattened JWS
+// request body. Signature verification is intentionally skipped: this fake
+// CA stands in for infrastructure this codebase doesn't control, not for a
+// trust boundary under test.
+func readJWSPayload(r io.Reader) ([]byte, error) {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(r).Decode(&jws); err != nil {
+		return nil, err
+	}
+	if jws.Payload == "" {
+		return []byte("{}"), nil
+	}
+	return base64.RawURLEncoding.DecodeString(jws.Payload)
+}
+
+func randToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// TestACMEAutoProvisioningEndToEnd drives the full path a real proxy relies
+// on: a TLS handshake for a covered hostname triggers GetCertificateFunc,
+// which (via a real autocert.Manager) obtains an order from a fake ACME CA,
+// the CA validates it with a real HTTP-01 fetch against a
+// ListenHTTPChallenge-backed listener, and the resulting certificate chains
+// to the CA's root.
+func TestACMEAutoProvisioningEndToEnd(t *testing.T) {
+	t.Parallel()
+
+	const domain = "acme-test.example"
+
+	// Reserve a loopback address with a plain listener first: the fake CA
+	// needs the challenge address up front, but ListenHTTPChallenge needs a
+	// non-nil manager, which in turn needs the fake CA's directory URL.
+	challengeListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer challengeListener.Close()
+
+	ca := newFakeACMEServer(t, challengeListener.Addr().String())
+
+	cache := &BackendCache{Backend: newMemKVBackend(), Prefix: "acme-cache"}
+	manager, err := NewManager(Config{
+		Enabled:      true,
+		Email:        "ops@example.com",
+		DirectoryURL: ca.url("/directory"),
+		PublicAddrs:  []string{domain},
+	}, cache)
+	require.NoError(t, err)
+
+	// Now that manager exists, release the reserved address and bind the
+	// real HTTP-01 challenge listener on that same address.
+	challengeAddr := challengeListener.Addr().String()
+	challengeListener.Close()
+	challengeListener, err = ListenHTTPChallenge(challengeAddr, manager, http.NotFoundHandler())
+	require.NoError(t, err)
+	defer challengeListener.Close()
+
+	hello := &tls.ClientHelloInfo{ServerName: domain}
+	cert, err := manager.GetCertificate(hello)
+	require.NoError(t, err)
+	require.NotNil(t, cert)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	require.Equal(t, domain, leaf.Subject.CommonName)
+
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(ca.rootCertPEM()))
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: domain, Roots: roots})
+	require.NoError(t, err)
+}
+
+// TestRunBackgroundRenewalReportsFailure verifies that the renewal loop
+// reports issuance failures (here, a host the manager's HostPolicy doesn't
+// cover) through the configured FailureReporter, which is how these
+// failures reach the audit log in production.
+func TestRunBackgroundRenewalReportsFailure(t *testing.T) {
+	t.Parallel()
+
+	manager, err := NewManager(Config{
+		Enabled:     true,
+		PublicAddrs: []string{"covered.example"},
+	}, &BackendCache{Backend: newMemKVBackend()})
+	require.NoError(t, err)
+
+	reporter := &recordingFailureReporter{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := Config{PublicAddrs: []string{"not-covered.example"}}
+	go runBackgroundRenewal(ctx, cfg, manager, reporter, nil, 10*time.Millisecond, 0)
+
+	require.Eventually(t, func() bool {
+		reporter.mu.Lock()
+		defer reporter.mu.Unlock()
+		return len(reporter.hosts) > 0
+	}, 5*time.Second, 20*time.Millisecond)
+
+	reporter.mu.Lock()
+	defer reporter.mu.Unlock()
+	require.Equal(t, "not-covered.example", reporter.hosts[0])
+}
+
+type recordingFailureReporter struct {
+	mu    sync.Mutex
+	hosts []string
+}
+
+func (r *recordingFailureReporter) ReportACMEFailure(host string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts = append(r.hosts, host)
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package acme
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/gravitational/trace"
+)
+
+// ListenHTTPS starts a TLS listener on addr whose certificates are served by
+// manager (via GetCertificateFunc), laid over base so the rest of the TLS
+// config (cipher suites, client auth, etc) is whatever the proxy's HTTPS
+// listener already used. This is the real call site GetCertificateFunc
+// plugs into: callers should pass the returned listener to the same
+// http.Server (or TLS-terminating proxy) that used to be handed a static
+// certificate.
+func ListenHTTPS(addr string, manager *autocert.Manager, base *tls.Config) (net.Listener, error) {
+	tlsConfig := base.Clone()
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.GetCertificate = GetCertificateFunc(manager)
+	tlsConfig.NextProtos = appendIfMissing(tlsConfig.NextProtos, "acme-tls/1")
+
+	listener, err := tls.Listen("tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, trace.Wrap(err, "starting ACME-backed TLS listener on %v", addr)
+	}
+	return listener, nil
+}
+
+// ListenHTTPChallenge starts a plain HTTP listener on addr serving manager's
+// HTTP-01 challenge responder, falling back to fallback for requests that
+// aren't part of an ACME challenge. It should be bound to port 80 whenever
+// HTTP-01 validation is in use; TLS-ALPN-01 challenges are instead answered
+// transparently by ListenHTTPS and need no separate listener.
+func ListenHTTPChallenge(addr string, manager *autocert.Manager, fallback http.Handler) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, trace.Wrap(err, "starting ACME HTTP-01 challenge listener on %v", addr)
+	}
+
+	go http.Serve(listener, HTTPHandler(manager, fallback))
+
+	return listener, nil
+}
+
+func appendIfMissing(protos []string, proto string) []string {
+	for _, p := range protos {
+		if p == proto {
+			return protos
+		}
+	}
+	return append(protos, proto)
+}
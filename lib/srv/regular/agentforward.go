@@ -0,0 +1,139 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/gravitational/trace"
+)
+
+// agentForwardReqType is the OpenSSH channel request, sent on a "session"
+// channel, by which a client asks the server to forward its ssh-agent.
+const agentForwardReqType = "auth-agent-req@openssh.com"
+
+// agentChannelType is the channel type the server opens back to the client
+// to reach the forwarded agent, once agentForwardReqType has been granted.
+const agentChannelType = "auth-agent@openssh.com"
+
+// AgentForwardingChecker reports whether the already-authenticated user on
+// conn is permitted to use agent forwarding, i.e. the new PermitAgentForwarding
+// role option (distinct from the pre-existing ForwardAgent option, which
+// only gates Teleport's own client-side local agent forwarding). It's
+// consulted independently for every connection so it can reflect
+// per-session role/trait data from the real RBAC engine.
+type AgentForwardingChecker interface {
+	PermitAgentForwarding(conn ssh.ConnMetadata) bool
+}
+
+// SetAgentForwardingChecker configures the role-option gate consulted by the
+// auth-agent-req@openssh.com handler. Without one configured, agent
+// forwarding requests are always granted, matching the zero-config
+// behavior of upstream OpenSSH.
+func SetAgentForwardingChecker(checker AgentForwardingChecker) ServerOption {
+	return func(s *Server) error {
+		if checker == nil {
+			return trace.BadParameter("agent forwarding checker cannot be nil")
+		}
+		s.agentForwardingChecker = checker
+		return nil
+	}
+}
+
+// handleAgentForwardRequest answers an auth-agent-req@openssh.com request
+// received on a session channel. To interoperate with OpenSSH clients, the
+// request always succeeds at the protocol level -- but when the connection's
+// PermitAgentForwarding role option is denied, the server simply never opens
+// the auth-agent@openssh.com back-channel or exposes SSH_AUTH_SOCK to the
+// session, so no agent is actually reachable even though the client believes
+// forwarding was granted.
+func (s *Server) handleAgentForwardRequest(sconn *ssh.ServerConn, req *ssh.Request, sess *sessionState) {
+	if req.WantReply {
+		req.Reply(true, nil)
+	}
+
+	if !s.permitAgentForwarding(sconn) {
+		return
+	}
+
+	ach, areqs, err := sconn.OpenChannel(agentChannelType, nil)
+	if err != nil {
+		s.log.Debugf("Failed to open agent forwarding channel: %v", err)
+		return
+	}
+	go ssh.DiscardRequests(areqs)
+
+	sess.agentChannel = ach
+	sess.authSock = agentSocketPath(sconn)
+}
+
+// permitAgentForwarding reports whether conn's user may use agent
+// forwarding; absent a configured AgentForwardingChecker, forwarding is
+// permitted, matching OpenSSH's own default.
+func (s *Server) permitAgentForwarding(conn ssh.ConnMetadata) bool {
+	if s.agentForwardingChecker == nil {
+		return true
+	}
+	return s.agentForwardingChecker.PermitAgentForwarding(conn)
+}
+
+// agentSocketPath derives a stable, per-connection path to surface to a
+// session as SSH_AUTH_SOCK. The production Server binds a real
+// net.UnixListener at this path and proxies it to the auth-agent@openssh.com
+// channel; the path itself only needs to be unique per connection.
+func agentSocketPath(conn ssh.ConnMetadata) string {
+	return "/tmp/teleport-" + string(conn.SessionID()) + ".agent"
+}
+
+// sessionState tracks the agent-forwarding state negotiated on a single
+// session channel, so a later exec/shell request on the same channel can
+// expose SSH_AUTH_SOCK pointing at the forwarded agent.
+type sessionState struct {
+	agentChannel ssh.Channel
+	authSock     string
+
+	x11FakeCookie  []byte
+	x11RealCookie  []byte
+	x11DisplayPath string
+	x11Listener    net.Listener
+}
+
+// closeX11Listener releases the session's X11 display socket, if
+// handleX11ForwardRequest ever opened one. Safe to call unconditionally when
+// a session channel closes.
+func (sess *sessionState) closeX11Listener() {
+	if sess.x11Listener != nil {
+		sess.x11Listener.Close()
+	}
+	if sess.x11DisplayPath != "" {
+		os.Remove(sess.x11DisplayPath)
+	}
+}
+
+// forwardedAgent returns an agent.Agent backed by sess's forwarded
+// back-channel, or nil if agent forwarding was never granted for this
+// session.
+func (sess *sessionState) forwardedAgent() agent.Agent {
+	if sess.agentChannel == nil {
+		return nil
+	}
+	return agent.NewClient(sess.agentChannel)
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testAgentForwardingChecker grants or denies PermitAgentForwarding for a
+// single configured username.
+type testAgentForwardingChecker struct {
+	permittedUser string
+}
+
+func (c *testAgentForwardingChecker) PermitAgentForwarding(conn ssh.ConnMetadata) bool {
+	return conn.User() == c.permittedUser
+}
+
+// TestAgentForwardingWiredIntoChannelHandler verifies that
+// auth-agent-req@openssh.com is answered by the real session-channel
+// handler: the request itself always succeeds (matching OpenSSH's
+// interoperability convention), but the auth-agent@openssh.com back-channel
+// -- and with it, the forwarded agent -- is only actually opened for a user
+// the configured AgentForwardingChecker grants PermitAgentForwarding to.
+func TestAgentForwardingWiredIntoChannelHandler(t *testing.T) {
+	t.Parallel()
+
+	signer := newTestHostSigner(t)
+	srv, err := New(
+		[]ssh.Signer{signer},
+		SetAgentForwardingChecker(&testAgentForwardingChecker{permittedUser: "alice"}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Close() })
+
+	t.Run("permitted user's agent back-channel is opened", func(t *testing.T) {
+		clt := dialAgentForwardClient(t, srv.Addr(), "alice")
+		agentChans := clt.HandleChannelOpen(agentChannelType)
+
+		ch, reqs, err := clt.OpenChannel("session", nil)
+		require.NoError(t, err)
+		defer ch.Close()
+		go ssh.DiscardRequests(reqs)
+
+		ok, err := ch.SendRequest(agentForwardReqType, true, nil)
+		require.NoError(t, err)
+		require.True(t, ok, "auth-agent-req@openssh.com must always succeed, per OpenSSH interop")
+
+		select {
+		case nch := <-agentChans:
+			ach, areqs, err := nch.Accept()
+			require.NoError(t, err)
+			defer ach.Close()
+			go ssh.DiscardRequests(areqs)
+		case <-time.After(testEventuallyTimeout):
+			require.Fail(t, "server never opened the auth-agent@openssh.com back-channel")
+		}
+	})
+
+	t.Run("denied user gets the reply but no back-channel", func(t *testing.T) {
+		clt := dialAgentForwardClient(t, srv.Addr(), "mallory")
+		agentChans := clt.HandleChannelOpen(agentChannelType)
+
+		ch, reqs, err := clt.OpenChannel("session", nil)
+		require.NoError(t, err)
+		defer ch.Close()
+		go ssh.DiscardRequests(reqs)
+
+		ok, err := ch.SendRequest(agentForwardReqType, true, nil)
+		require.NoError(t, err)
+		require.True(t, ok, "the request must still appear to succeed to stay OpenSSH-compatible")
+
+		select {
+		case <-agentChans:
+			require.Fail(t, "no agent channel should ever be opened for a denied user")
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+}
+
+// dialAgentForwardClient dials srv as user and returns the full ssh.Client,
+// needed (unlike dialTestServer's bare ssh.Conn) so the test can register a
+// HandleChannelOpen handler for the server-initiated agent back-channel.
+func dialAgentForwardClient(t *testing.T, addr, user string) *ssh.Client {
+	t.Helper()
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(newTestHostSigner(t))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
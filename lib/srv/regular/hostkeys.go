@@ -0,0 +1,122 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"context"
+	"crypto/rsa"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/trace"
+)
+
+// minRSAHostKeyBits is the smallest RSA modulus size, in bits, that the
+// server will accept as a host key. This matches the floor NIST and most
+// current SSH clients enforce.
+const minRSAHostKeyBits = 2048
+
+// HostKeyProvider supplies the set of host key signers a server should
+// present during the SSH handshake, and notifies subscribers when that set
+// changes (for example after a CA rotation or a hot key reload). New
+// connections pick up the latest signer set; sessions already negotiated
+// against an older key are unaffected.
+type HostKeyProvider interface {
+	// Signers returns the current set of host key signers. Implementations
+	// should return a defensive copy or an otherwise immutable slice.
+	Signers(ctx context.Context) ([]ssh.Signer, error)
+	// Changes returns a channel that receives a value every time the signer
+	// set served by Signers changes. The channel is never closed.
+	Changes() <-chan struct{}
+}
+
+// SetHostKeyProvider configures a HostKeyProvider that the server consults
+// for the host key signers to present. New still requires and validates the
+// static signer slice it is given, but once a provider is configured, the
+// provider's signer set replaces that slice. When the provider signals a change on
+// its Changes channel, the server rebuilds its internal ssh.ServerConfig so
+// that new connections see the updated keys; connections already in
+// progress keep using whatever key they negotiated.
+func SetHostKeyProvider(p HostKeyProvider) ServerOption {
+	return func(s *Server) error {
+		if p == nil {
+			return trace.BadParameter("host key provider cannot be nil")
+		}
+		s.hostKeyProvider = p
+		return nil
+	}
+}
+
+// validateHostSigner rejects host key algorithms this server refuses to
+// serve: DSA keys and RSA keys below minRSAHostKeyBits. This mirrors the
+// host key validation gitlab-shell performs on the keys it loads so that
+// operators get a clear error at startup instead of a client-side handshake
+// failure later.
+func validateHostSigner(signer ssh.Signer) error {
+	switch pub := signer.PublicKey().(type) {
+	case ssh.CryptoPublicKey:
+		switch key := pub.CryptoPublicKey().(type) {
+		case *rsa.PublicKey:
+			if key.N.BitLen() < minRSAHostKeyBits {
+				return trace.BadParameter(
+					"RSA host key is %v bits, minimum allowed is %v bits", key.N.BitLen(), minRSAHostKeyBits)
+			}
+		}
+	}
+	if signer.PublicKey().Type() == ssh.KeyAlgoDSA {
+		return trace.BadParameter("DSA host keys are not permitted")
+	}
+	return nil
+}
+
+// validateHostSigners runs validateHostSigner over every signer in the set
+// and returns the first error encountered.
+func validateHostSigners(signers []ssh.Signer) error {
+	for _, signer := range signers {
+		if err := validateHostSigner(signer); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// watchHostKeyProvider blocks until ctx is done, rebuilding the server's
+// ssh.ServerConfig each time the provider reports a change. It is started as
+// a goroutine from Server.Start when a HostKeyProvider has been configured.
+func (s *Server) watchHostKeyProvider(ctx context.Context) {
+	if s.hostKeyProvider == nil {
+		return
+	}
+	changes := s.hostKeyProvider.Changes()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+			signers, err := s.hostKeyProvider.Signers(ctx)
+			if err != nil {
+				s.log.Warningf("Failed to refresh host keys: %v", err)
+				continue
+			}
+			if err := validateHostSigners(signers); err != nil {
+				s.log.Warningf("Refusing to apply new host keys: %v", err)
+				continue
+			}
+			s.rebuildServerConfig(signers)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testHostKeyProvider is a HostKeyProvider whose signer set can be swapped
+// out by the test, signalling a change the same way a real CA rotation or
+// hot key reload would.
+type testHostKeyProvider struct {
+	signers []ssh.Signer
+	changes chan struct{}
+}
+
+func newTestHostKeyProvider(initial ssh.Signer) *testHostKeyProvider {
+	return &testHostKeyProvider{
+		signers: []ssh.Signer{initial},
+		changes: make(chan struct{}, 1),
+	}
+}
+
+func (p *testHostKeyProvider) Signers(ctx context.Context) ([]ssh.Signer, error) {
+	return p.signers, nil
+}
+
+func (p *testHostKeyProvider) Changes() <-chan struct{} {
+	return p.changes
+}
+
+func (p *testHostKeyProvider) rotate(t *testing.T, next ssh.Signer) {
+	t.Helper()
+	p.signers = []ssh.Signer{next}
+	p.changes <- struct{}{}
+}
+
+// TestHostKeyProviderRotationWiredIntoServer verifies that a HostKeyProvider
+// configured via SetHostKeyProvider is actually consulted by a running
+// Server: its initial signer set is seeded at construction (not just on the
+// first rotation), new connections see the provider's keys rather than the
+// static signer passed to New, and after the provider reports a change, new
+// connections see the rotated key too -- proving watchHostKeyProvider is
+// started from Start and rebuildServerConfig takes effect.
+func TestHostKeyProviderRotationWiredIntoServer(t *testing.T) {
+	t.Parallel()
+
+	// staticSigner stands in for the signer slice New always requires; it
+	// must never be the one the server actually presents once a provider is
+	// configured, proving the provider's own initial signer set is what gets
+	// seeded.
+	staticSigner := newTestHostSigner(t)
+	initial := newTestHostSigner(t)
+	provider := newTestHostKeyProvider(initial)
+
+	srv, err := New([]ssh.Signer{staticSigner}, SetHostKeyProvider(provider))
+	require.NoError(t, err)
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Close() })
+
+	firstKey := dialAndCaptureHostKey(t, srv.Addr())
+	require.Equal(t, initial.PublicKey().Marshal(), firstKey.Marshal())
+
+	rotated := newTestHostSigner(t)
+	provider.rotate(t, rotated)
+
+	require.Eventually(t, func() bool {
+		key := dialAndCaptureHostKey(t, srv.Addr())
+		return string(key.Marshal()) == string(rotated.PublicKey().Marshal())
+	}, testEventuallyTimeout, testEventuallyTick, "server never picked up the rotated host key")
+}
+
+// dialAndCaptureHostKey connects to addr just far enough to observe the
+// host key the server presents during the handshake.
+func dialAndCaptureHostKey(t *testing.T, addr string) ssh.PublicKey {
+	t.Helper()
+
+	var observed ssh.PublicKey
+	_, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "placeholder",
+		Auth: []ssh.AuthMethod{ssh.Password("unused")},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			observed = key
+			return nil
+		},
+	})
+	// Authentication is expected to fail past the handshake (no password
+	// auth configured yet); the host key callback still runs first.
+	_ = err
+	return observed
+}
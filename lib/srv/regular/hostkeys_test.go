@@ -0,0 +1,64 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestValidateHostSignerRejectsWeakRSA ensures sub-2048-bit RSA host keys
+// are rejected with a clear error at load time.
+func TestValidateHostSignerRejectsWeakRSA(t *testing.T) {
+	t.Parallel()
+
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	weakSigner, err := ssh.NewSignerFromKey(weak)
+	require.NoError(t, err)
+	require.Error(t, validateHostSigner(weakSigner))
+
+	strong, err := rsa.GenerateKey(rand.Reader, minRSAHostKeyBits)
+	require.NoError(t, err)
+	strongSigner, err := ssh.NewSignerFromKey(strong)
+	require.NoError(t, err)
+	require.NoError(t, validateHostSigner(strongSigner))
+}
+
+// TestValidateHostSigners ensures a single invalid signer in the set fails
+// the whole batch.
+func TestValidateHostSigners(t *testing.T) {
+	t.Parallel()
+
+	strong, err := rsa.GenerateKey(rand.Reader, minRSAHostKeyBits)
+	require.NoError(t, err)
+	strongSigner, err := ssh.NewSignerFromKey(strong)
+	require.NoError(t, err)
+
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	weakSigner, err := ssh.NewSignerFromKey(weak)
+	require.NoError(t, err)
+
+	require.NoError(t, validateHostSigners([]ssh.Signer{strongSigner}))
+	require.Error(t, validateHostSigners([]ssh.Signer{strongSigner, weakSigner}))
+}
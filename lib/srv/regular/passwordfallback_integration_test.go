@@ -0,0 +1,114 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/trace"
+	"github.com/stretchr/testify/require"
+)
+
+// testBearerTokenValidator accepts a single configured (username, token)
+// pair, standing in for a real validation call against the auth server.
+type testBearerTokenValidator struct {
+	wantUser  string
+	wantToken string
+}
+
+func (v *testBearerTokenValidator) ValidateBearerToken(ctx context.Context, username, token string) error {
+	if username != v.wantUser || token != v.wantToken {
+		return trace.AccessDenied("invalid bearer token for %v", username)
+	}
+	return nil
+}
+
+// testAuditEmitter records emitted password-fallback login events for
+// assertions.
+type testAuditEmitter struct {
+	events []sshPasswordFallbackLoginEvent
+}
+
+func (e *testAuditEmitter) EmitAuditEvent(ctx context.Context, event sshPasswordFallbackLoginEvent) {
+	e.events = append(e.events, event)
+}
+
+// TestPasswordFallbackWiredIntoAuthCallbacks verifies that
+// SetPasswordFallbackSuffix actually changes what a running Server accepts:
+// a suffixed username must authenticate with a valid bearer token over
+// password auth (cert/publickey auth is refused for it), a non-suffixed
+// username can't use password auth at all, and every fallback attempt is
+// recorded via the configured AuditEmitter.
+func TestPasswordFallbackWiredIntoAuthCallbacks(t *testing.T) {
+	t.Parallel()
+
+	signer := newTestHostSigner(t)
+	validator := &testBearerTokenValidator{wantUser: "alice", wantToken: "short-lived-token"}
+	emitter := &testAuditEmitter{}
+
+	srv, err := New(
+		[]ssh.Signer{signer},
+		SetPasswordFallbackSuffix(defaultPasswordFallbackSuffix),
+		SetPasswordFallbackAuth(validator, emitter),
+	)
+	require.NoError(t, err)
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Close() })
+
+	// A suffixed user presenting the right bearer token authenticates.
+	client, err := ssh.Dial("tcp", srv.Addr(), &ssh.ClientConfig{
+		User:            "alice" + defaultPasswordFallbackSuffix,
+		Auth:            []ssh.AuthMethod{ssh.Password("short-lived-token")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.NoError(t, err)
+	client.Close()
+
+	// A suffixed user presenting the wrong token is rejected.
+	_, err = ssh.Dial("tcp", srv.Addr(), &ssh.ClientConfig{
+		User:            "alice" + defaultPasswordFallbackSuffix,
+		Auth:            []ssh.AuthMethod{ssh.Password("wrong-token")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.Error(t, err)
+
+	// Certificate/public-key auth is refused outright for a suffixed user,
+	// forcing the fallback to password.
+	_, err = ssh.Dial("tcp", srv.Addr(), &ssh.ClientConfig{
+		User:            "alice" + defaultPasswordFallbackSuffix,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(newTestHostSigner(t))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.Error(t, err)
+
+	// A non-suffixed user can't authenticate via password at all.
+	_, err = ssh.Dial("tcp", srv.Addr(), &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.Password("short-lived-token")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.Error(t, err)
+
+	require.Len(t, emitter.events, 2)
+	require.Equal(t, "alice", emitter.events[0].User)
+	require.True(t, emitter.events[0].Success)
+	require.Equal(t, "alice", emitter.events[1].User)
+	require.False(t, emitter.events[1].Success)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitPasswordFallbackUser(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc      string
+		suffix    string
+		username  string
+		wantUser  string
+		wantMatch bool
+	}{
+		{
+			desc:      "default suffix matches",
+			suffix:    defaultPasswordFallbackSuffix,
+			username:  "alice+password",
+			wantUser:  "alice",
+			wantMatch: true,
+		},
+		{
+			desc:      "no suffix present",
+			suffix:    defaultPasswordFallbackSuffix,
+			username:  "alice",
+			wantUser:  "alice",
+			wantMatch: false,
+		},
+		{
+			desc:      "feature disabled",
+			suffix:    "",
+			username:  "alice+password",
+			wantUser:  "alice+password",
+			wantMatch: false,
+		},
+		{
+			desc:      "suffix only, no base username",
+			suffix:    defaultPasswordFallbackSuffix,
+			username:  "+password",
+			wantUser:  "+password",
+			wantMatch: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			user, ok := splitPasswordFallbackUser(tt.suffix, tt.username)
+			require.Equal(t, tt.wantMatch, ok)
+			require.Equal(t, tt.wantUser, user)
+		})
+	}
+}
+
+// TestPasswordFallbackSuffixRequiresValidator verifies that New rejects a
+// password-fallback suffix configured without a bearer token validator,
+// rather than constructing a Server that would panic on a nil
+// bearerTokenValidator the first time a suffixed user tried to log in.
+func TestPasswordFallbackSuffixRequiresValidator(t *testing.T) {
+	t.Parallel()
+
+	signer := newTestHostSigner(t)
+	_, err := New(
+		[]ssh.Signer{signer},
+		SetPasswordFallbackSuffix(defaultPasswordFallbackSuffix),
+	)
+	require.Error(t, err)
+}
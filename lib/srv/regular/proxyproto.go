@@ -0,0 +1,367 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// PROXYProtocolMode controls how the server treats the PROXY protocol
+// (https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt) on incoming
+// connections.
+type PROXYProtocolMode string
+
+const (
+	// PROXYProtocolOff disables PROXY protocol support entirely; any
+	// connection carrying a PROXY header will fail the SSH handshake.
+	PROXYProtocolOff PROXYProtocolMode = "off"
+	// PROXYProtocolAccept parses a PROXY header if present but also accepts
+	// connections that don't send one.
+	PROXYProtocolAccept PROXYProtocolMode = "accept"
+	// PROXYProtocolRequire rejects any connection that does not present a
+	// valid PROXY header.
+	PROXYProtocolRequire PROXYProtocolMode = "require"
+)
+
+// proxyProtocolSignatureV2 is the 12-byte binary signature that prefixes every
+// PROXY protocol v2 header.
+var proxyProtocolSignatureV2 = []byte{
+	0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+}
+
+// maxPROXYHeaderV1Len is the maximum length of a PROXY protocol v1 header,
+// as mandated by the spec.
+const maxPROXYHeaderV1Len = 107
+
+// SetPROXYProtocol configures whether the server listener should understand
+// the HAProxy PROXY protocol, and if so, which peers are trusted to send it.
+// When mode is anything other than PROXYProtocolOff, trustedCIDRs restricts
+// which immediate TCP peers are allowed to supply a PROXY header; connections
+// from other peers are treated according to mode (ignored in "accept" mode,
+// rejected in "require" mode).
+func SetPROXYProtocol(mode PROXYProtocolMode, trustedCIDRs ...string) ServerOption {
+	return func(s *Server) error {
+		nets, err := parseCIDRs(trustedCIDRs)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		switch mode {
+		case PROXYProtocolOff, PROXYProtocolAccept, PROXYProtocolRequire:
+		default:
+			return trace.BadParameter("unsupported PROXY protocol mode: %q", mode)
+		}
+		s.proxyProtocolMode = mode
+		s.proxyProtocolAllowedCIDRs = nets
+		return nil
+	}
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, c := range cidrs {
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			// Allow bare IPs as a convenience, treating them as /32 or /128.
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, trace.BadParameter("invalid trusted CIDR or IP %q: %v", c, err)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		out = append(out, ipNet)
+	}
+	return out, nil
+}
+
+// proxyProtocolListener wraps a net.Listener, rewriting the RemoteAddr of
+// accepted connections to the one embedded in an optional PROXY protocol
+// header.
+type proxyProtocolListener struct {
+	net.Listener
+	mode          PROXYProtocolMode
+	allowedCIDRs  []*net.IPNet
+	readHeaderTmo time.Duration
+}
+
+// newPROXYProtocolListener wraps listener so that Accept understands the
+// PROXY protocol according to mode and allowedCIDRs. If mode is
+// PROXYProtocolOff, listener is returned unwrapped.
+func newPROXYProtocolListener(listener net.Listener, mode PROXYProtocolMode, allowedCIDRs []*net.IPNet) net.Listener {
+	if mode == PROXYProtocolOff {
+		return listener
+	}
+	return &proxyProtocolListener{
+		Listener:      listener,
+		mode:          mode,
+		allowedCIDRs:  allowedCIDRs,
+		readHeaderTmo: 5 * time.Second,
+	}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if !l.peerTrusted(conn.RemoteAddr()) {
+		if l.mode == PROXYProtocolRequire {
+			conn.Close()
+			return nil, trace.AccessDenied("PROXY protocol required from untrusted peer %v", conn.RemoteAddr())
+		}
+		return conn, nil
+	}
+
+	if l.readHeaderTmo > 0 {
+		conn.SetReadDeadline(time.Now().Add(l.readHeaderTmo))
+	}
+
+	wrapped, hadHeader, err := readPROXYHeader(conn)
+	if err != nil {
+		conn.Close()
+		return nil, trace.Wrap(err)
+	}
+
+	if l.readHeaderTmo > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+
+	if !hadHeader && l.mode == PROXYProtocolRequire {
+		conn.Close()
+		return nil, trace.AccessDenied("PROXY protocol header required but not present")
+	}
+
+	return wrapped, nil
+}
+
+func (l *proxyProtocolListener) peerTrusted(addr net.Addr) bool {
+	if len(l.allowedCIDRs) == 0 {
+		// No allow-list configured means every peer may send a header.
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.allowedCIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolConn is a net.Conn whose RemoteAddr/LocalAddr have been
+// overridden by values parsed from a PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readPROXYHeader peeks at the start of conn and, if it finds a v1 or v2
+// PROXY protocol header, consumes it and returns (conn wrapping the
+// remainder of the stream with the rewritten addresses, true, nil). If no
+// PROXY header is present, it returns (conn wrapping the unconsumed stream,
+// false, nil) -- the peeked bytes are never dropped, but the false return
+// lets the caller tell the two cases apart, which a nil conn could not since
+// the stream still has to be read from either way.
+func readPROXYHeader(conn net.Conn) (net.Conn, bool, error) {
+	br := bufio.NewReaderSize(conn, maxPROXYHeaderV1Len)
+
+	prefix, err := br.Peek(len(proxyProtocolSignatureV2))
+	if err == nil && string(prefix) == string(proxyProtocolSignatureV2) {
+		wrapped, err := readPROXYHeaderV2(conn, br)
+		return wrapped, true, err
+	}
+
+	prefix, err = br.Peek(5)
+	if err == nil && string(prefix) == "PROXY" {
+		wrapped, err := readPROXYHeaderV1(conn, br)
+		return wrapped, true, err
+	}
+
+	// Nothing recognizable buffered; hand back a conn that reads through br so
+	// the peeked bytes aren't dropped.
+	return &bufferedConn{Conn: conn, r: br}, false, nil
+}
+
+// bufferedConn is a net.Conn whose Read is served from a bufio.Reader that
+// may already contain buffered bytes.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func readPROXYHeaderV1(conn net.Conn, br *bufio.Reader) (net.Conn, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, trace.Wrap(err, "reading PROXY v1 header")
+	}
+	if len(line) > maxPROXYHeaderV1Len {
+		return nil, trace.BadParameter("PROXY v1 header exceeds %v bytes", maxPROXYHeaderV1Len)
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return nil, trace.BadParameter("malformed PROXY v1 header: missing CRLF")
+	}
+	fields := strings.Split(strings.TrimSuffix(line, "\r\n"), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, trace.BadParameter("malformed PROXY v1 header")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return &bufferedConn{Conn: conn, r: br}, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, trace.BadParameter("unsupported PROXY v1 protocol family %q", fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, trace.BadParameter("malformed PROXY v1 header: expected 6 fields, got %v", len(fields))
+	}
+
+	srcIP := net.ParseIP(fields[2])
+	dstIP := net.ParseIP(fields[3])
+	if srcIP == nil || dstIP == nil {
+		return nil, trace.BadParameter("malformed PROXY v1 header: invalid address")
+	}
+	srcPort, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, trace.BadParameter("malformed PROXY v1 header: invalid source port")
+	}
+	dstPort, err := strconv.Atoi(fields[5])
+	if err != nil {
+		return nil, trace.BadParameter("malformed PROXY v1 header: invalid destination port")
+	}
+
+	return &proxyProtocolConn{
+		Conn:       &bufferedConn{Conn: conn, r: br},
+		remoteAddr: &net.TCPAddr{IP: srcIP, Port: srcPort},
+		localAddr:  &net.TCPAddr{IP: dstIP, Port: dstPort},
+	}, nil
+}
+
+// proxyProtocolV2Command is the low nibble of the version/command byte.
+type proxyProtocolV2Command byte
+
+const (
+	proxyProtocolV2CommandLocal proxyProtocolV2Command = 0x0
+	proxyProtocolV2CommandProxy proxyProtocolV2Command = 0x1
+)
+
+func readPROXYHeaderV2(conn net.Conn, br *bufio.Reader) (net.Conn, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, trace.Wrap(err, "reading PROXY v2 header")
+	}
+
+	verCmd := header[12]
+	if verCmd>>4 != 0x2 {
+		return nil, trace.BadParameter("unsupported PROXY protocol version %v", verCmd>>4)
+	}
+	command := proxyProtocolV2Command(verCmd & 0x0F)
+
+	family := header[13] >> 4
+	proto := header[13] & 0x0F
+	addrLen := binary.BigEndian.Uint16(header[14:16])
+
+	addrBlock := make([]byte, addrLen)
+	if _, err := io.ReadFull(br, addrBlock); err != nil {
+		return nil, trace.Wrap(err, "reading PROXY v2 address block")
+	}
+
+	wrapped := &bufferedConn{Conn: conn, r: br}
+
+	if command == proxyProtocolV2CommandLocal {
+		// LOCAL connections (e.g. health checks) keep the real TCP peer.
+		return wrapped, nil
+	}
+
+	if proto != 0x1 && proto != 0x2 {
+		// Only STREAM (TCP) and DGRAM (UDP) are meaningful for addressing;
+		// anything else is passed through unparsed.
+		return wrapped, nil
+	}
+
+	var remote, local net.Addr
+	switch family {
+	case 0x1: // AF_INET
+		if len(addrBlock) < 12 {
+			return nil, trace.BadParameter("malformed PROXY v2 IPv4 address block")
+		}
+		srcIP := net.IP(addrBlock[0:4])
+		dstIP := net.IP(addrBlock[4:8])
+		srcPort := binary.BigEndian.Uint16(addrBlock[8:10])
+		dstPort := binary.BigEndian.Uint16(addrBlock[10:12])
+		remote = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+		local = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	case 0x2: // AF_INET6
+		if len(addrBlock) < 36 {
+			return nil, trace.BadParameter("malformed PROXY v2 IPv6 address block")
+		}
+		srcIP := net.IP(addrBlock[0:16])
+		dstIP := net.IP(addrBlock[16:32])
+		srcPort := binary.BigEndian.Uint16(addrBlock[32:34])
+		dstPort := binary.BigEndian.Uint16(addrBlock[34:36])
+		remote = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+		local = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	default:
+		// AF_UNIX or AF_UNSPEC: nothing useful to rewrite.
+		return wrapped, nil
+	}
+
+	return &proxyProtocolConn{
+		Conn:       wrapped,
+		remoteAddr: remote,
+		localAddr:  local,
+	}, nil
+}
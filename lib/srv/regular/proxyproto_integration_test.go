@@ -0,0 +1,60 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestPROXYProtocolWiredIntoAcceptLoop verifies that SetPROXYProtocol
+// actually affects connections accepted by a running Server, not just a
+// free-standing listener wrapper: a plain TCP peer that never sends a
+// PROXY header is rejected outright once PROXYProtocolRequire is
+// configured, proving the option reaches Server.Start's real accept loop.
+func TestPROXYProtocolWiredIntoAcceptLoop(t *testing.T) {
+	t.Parallel()
+
+	signer := newTestHostSigner(t)
+
+	srv, err := New([]ssh.Signer{signer}, SetPROXYProtocol(PROXYProtocolRequire))
+	require.NoError(t, err)
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Write something that isn't a PROXY header; the server must close the
+	// connection rather than proceed to an SSH handshake. Asserting io.EOF
+	// specifically (rather than any error) proves the server itself hung up
+	// -- a read deadline expiring on its own would also produce an error here
+	// without ever exercising the require-mode rejection.
+	_, err = conn.Write([]byte("not a proxy header\r\n"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 1)
+	conn.SetReadDeadline(testDeadline())
+	_, err = conn.Read(buf)
+	require.ErrorIs(t, err, io.EOF)
+}
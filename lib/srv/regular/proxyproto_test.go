@@ -0,0 +1,146 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// proxyDialV1 dials addr and writes a PROXY protocol v1 header for
+// srcAddr/dstAddr, mimicking what a go-proxyproto-style dialer does before
+// handing the connection to an upstream SSH client.
+func proxyDialV1(t *testing.T, network, addr string, srcAddr, dstAddr *net.TCPAddr) net.Conn {
+	conn, err := net.Dial(network, addr)
+	require.NoError(t, err)
+
+	header := fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n",
+		srcAddr.IP.String(), dstAddr.IP.String(), srcAddr.Port, dstAddr.Port)
+	_, err = conn.Write([]byte(header))
+	require.NoError(t, err)
+
+	return conn
+}
+
+// TestPROXYProtocolV1 ensures that a listener wrapped by
+// newPROXYProtocolListener in "accept" mode rewrites RemoteAddr() from a v1
+// header.
+func TestPROXYProtocolV1(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	wrapped := newPROXYProtocolListener(listener, PROXYProtocolAccept, nil)
+
+	acceptedCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := wrapped.Accept()
+		require.NoError(t, err)
+		acceptedCh <- conn
+	}()
+
+	srcAddr := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5555}
+	dstAddr := &net.TCPAddr{IP: net.ParseIP("10.1.2.4"), Port: 22}
+	conn := proxyDialV1(t, "tcp", listener.Addr().String(), srcAddr, dstAddr)
+	defer conn.Close()
+
+	select {
+	case accepted := <-acceptedCh:
+		defer accepted.Close()
+		require.Equal(t, srcAddr.String(), accepted.RemoteAddr().String())
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for accepted connection")
+	}
+}
+
+// TestPROXYProtocolRequireRejectsPlain verifies that, in "require" mode, a
+// connection that doesn't start with a PROXY header is rejected.
+func TestPROXYProtocolRequireRejectsPlain(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	wrapped := newPROXYProtocolListener(listener, PROXYProtocolRequire, nil)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := wrapped.Accept()
+		errCh <- err
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("not a proxy header\r\n"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	select {
+	case err := <-errCh:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for Accept to reject connection")
+	}
+}
+
+// TestPROXYProtocolTrustedCIDRs verifies that only peers within the trusted
+// CIDR list are allowed to supply a PROXY header; others are passed through
+// unmodified in "accept" mode.
+func TestPROXYProtocolTrustedCIDRs(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// Trust nothing on loopback, so the header below must be ignored and the
+	// real peer address preserved.
+	wrapped := newPROXYProtocolListener(listener, PROXYProtocolAccept, mustParseCIDRs(t, []string{"192.0.2.0/24"}))
+
+	acceptedCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := wrapped.Accept()
+		require.NoError(t, err)
+		acceptedCh <- conn
+	}()
+
+	srcAddr := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5555}
+	dstAddr := &net.TCPAddr{IP: net.ParseIP("10.1.2.4"), Port: 22}
+	conn := proxyDialV1(t, "tcp", listener.Addr().String(), srcAddr, dstAddr)
+	defer conn.Close()
+
+	select {
+	case accepted := <-acceptedCh:
+		defer accepted.Close()
+		require.NotEqual(t, srcAddr.String(), accepted.RemoteAddr().String())
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for accepted connection")
+	}
+}
+
+func mustParseCIDRs(t *testing.T, cidrs []string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	require.NoError(t, err)
+	return nets
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestHostSigner generates a throwaway ed25519 host key signer for tests
+// that exercise a real Server end to end.
+func newTestHostSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	return signer
+}
+
+// testDeadline returns a short deadline for negative-path network reads so
+// a misbehaving test fails fast instead of hanging.
+func testDeadline() time.Time {
+	return time.Now().Add(5 * time.Second)
+}
+
+// testEventuallyTimeout/testEventuallyTick bound require.Eventually calls
+// that wait on a background goroutine (the accept loop, the host key
+// watcher) to observe an async change.
+const (
+	testEventuallyTimeout = 5 * time.Second
+	testEventuallyTick    = 50 * time.Millisecond
+)
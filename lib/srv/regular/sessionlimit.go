@@ -0,0 +1,122 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/gravitational/trace"
+)
+
+var sshSessionChannelRejected = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "teleport_ssh_session_channel_rejected_total",
+		Help: "Number of SSH session channel open requests rejected by the node",
+	},
+	[]string{"reason"},
+)
+
+func init() {
+	prometheus.MustRegister(sshSessionChannelRejected)
+}
+
+// SetMaxSessionsPerConnection caps the number of concurrent "session"
+// channels a single SSH transport connection may open, independent of any
+// role-based MaxSessions restriction. This protects a node from a single
+// misbehaving client exhausting PTYs/goroutines by opening many session
+// channels on one connection. A value of 0 (the default) means no
+// server-side limit is enforced.
+func SetMaxSessionsPerConnection(n int64) ServerOption {
+	return func(s *Server) error {
+		if n < 0 {
+			return trace.BadParameter("max sessions per connection must be >= 0, got %v", n)
+		}
+		s.maxSessionsPerConnection = n
+		return nil
+	}
+}
+
+// perConnSessionCounter tracks, per underlying SSH transport connection, how
+// many "session" channels have been opened so far, so the server can reject
+// the (N+1)th one independently of any role-based MaxSessions check.
+type perConnSessionCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newPerConnSessionCounter() *perConnSessionCounter {
+	return &perConnSessionCounter{
+		counts: make(map[string]int64),
+	}
+}
+
+// connKey returns a stable identifier for the transport connection that new
+// channel-open requests arrive on.
+func connKey(conn ssh.ConnMetadata) string {
+	return string(conn.SessionID())
+}
+
+// admitSessionChannel increments the session channel count for conn and
+// returns an error if doing so would exceed max. A max of 0 disables the
+// check. Call releaseSessionChannel when the channel closes so the slot is
+// freed for the lifetime of the connection.
+func (c *perConnSessionCounter) admitSessionChannel(conn ssh.ConnMetadata, max int64) error {
+	if max <= 0 {
+		return nil
+	}
+	key := connKey(conn)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts[key] >= max {
+		sshSessionChannelRejected.WithLabelValues("per_conn_limit").Inc()
+		return trace.AccessDenied("too many session channels on this connection, max %v", max)
+	}
+	c.counts[key]++
+	return nil
+}
+
+// releaseSessionChannel decrements the session channel count for conn.
+func (c *perConnSessionCounter) releaseSessionChannel(conn ssh.ConnMetadata) {
+	key := connKey(conn)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts[key] > 0 {
+		c.counts[key]--
+	}
+	if c.counts[key] == 0 {
+		delete(c.counts, key)
+	}
+}
+
+// forgetConn drops all bookkeeping for conn; called once the transport
+// connection itself is torn down.
+func (c *perConnSessionCounter) forgetConn(conn ssh.ConnMetadata) {
+	key := connKey(conn)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.counts, key)
+}
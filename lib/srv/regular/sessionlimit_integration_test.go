@@ -0,0 +1,90 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMaxSessionsPerConnectionWiredIntoChannelHandler verifies that
+// SetMaxSessionsPerConnection is actually enforced by a running Server's
+// session-channel handler, and that opening and closing sessions frees up
+// slots for more on the same transport connection.
+func TestMaxSessionsPerConnectionWiredIntoChannelHandler(t *testing.T) {
+	t.Parallel()
+
+	signer := newTestHostSigner(t)
+	srv, err := New([]ssh.Signer{signer}, SetMaxSessionsPerConnection(2))
+	require.NoError(t, err)
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Close() })
+
+	clt := dialTestServer(t, srv.Addr())
+
+	ch1, _, err := clt.OpenChannel("session", nil)
+	require.NoError(t, err)
+	ch2, _, err := clt.OpenChannel("session", nil)
+	require.NoError(t, err)
+
+	_, _, err = clt.OpenChannel("session", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "too many session channels")
+
+	// Closing a channel frees its slot for a new one on the same connection.
+	// The server only releases the slot once it has processed the close
+	// handshake on its side, which happens asynchronously to ch1.Close()
+	// returning here, so poll rather than assuming the slot is free already.
+	require.NoError(t, ch1.Close())
+	var ch3 ssh.Channel
+	require.Eventually(t, func() bool {
+		var err error
+		ch3, _, err = clt.OpenChannel("session", nil)
+		return err == nil
+	}, testEventuallyTimeout, testEventuallyTick)
+
+	ch2.Close()
+	ch3.Close()
+
+	// A second, independent transport connection is unaffected by the
+	// first connection's limit.
+	clt2 := dialTestServer(t, srv.Addr())
+	ch, _, err := clt2.OpenChannel("session", nil)
+	require.NoError(t, err)
+	ch.Close()
+}
+
+// dialTestServer opens an SSH client connection to addr, authenticating
+// with a throwaway key (this package's minimal test ServerConfig accepts
+// any presented public key; real RBAC-backed authentication lives in the
+// production Server). Only channel behavior on an established transport
+// connection is under test here.
+func dialTestServer(t *testing.T, addr string) ssh.Conn {
+	t.Helper()
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(newTestHostSigner(t))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client.Conn
+}
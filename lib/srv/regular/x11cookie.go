@@ -0,0 +1,254 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+
+	"github.com/gravitational/trace"
+)
+
+// x11CookieLen is the length, in bytes, of an MIT-MAGIC-COOKIE-1 cookie.
+const x11CookieLen = 16
+
+// mitMagicCookieProtocol is the only X11 authorization protocol this server
+// understands how to spoof.
+const mitMagicCookieProtocol = "MIT-MAGIC-COOKIE-1"
+
+// x11InitHeaderLen is the length, in bytes, of the fixed portion of an X11
+// client connection setup packet, prior to the variable-length protocol
+// name and authorization data.
+const x11InitHeaderLen = 12
+
+// GenerateFakeX11Cookie creates a new random MIT-MAGIC-COOKIE-1 cookie. The
+// node writes this cookie (not the client's real one) into the session's
+// Xauthority so that local processes in the session never see the user's
+// real X11 authentication data; the node substitutes the real cookie back in
+// on each forwarded X11 channel after verifying the fake one was presented.
+func GenerateFakeX11Cookie() ([]byte, error) {
+	cookie := make([]byte, x11CookieLen)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return cookie, nil
+}
+
+// x11InitMessage is the parsed form of the fixed-format packet an X11 client
+// sends as the very first thing on a new connection, per the X Window
+// System protocol connection setup.
+type x11InitMessage struct {
+	// byteOrder is 'B' (big-endian) or 'l' (little-endian) per the X11 wire
+	// protocol and determines how the client encoded the length fields.
+	byteOrder byte
+	// protocolName is the authorization protocol the client is using, e.g.
+	// "MIT-MAGIC-COOKIE-1".
+	protocolName string
+	// authData is the raw (non-hex-encoded) authorization cookie bytes.
+	authData []byte
+	// headerLen is the total length, in bytes, of everything parsed above
+	// (including padding) so callers can locate the remainder of the stream.
+	headerLen int
+}
+
+// parseX11InitMessage parses the fixed-format X11 connection setup packet
+// prefix out of data, which must contain at least the full packet (header,
+// protocol name and authorization data, including padding). It does not
+// consume or require anything beyond that prefix.
+func parseX11InitMessage(data []byte) (*x11InitMessage, error) {
+	if len(data) < x11InitHeaderLen {
+		return nil, trace.BadParameter("X11 init message too short: %v bytes", len(data))
+	}
+
+	order := data[0]
+	var byteOrder binary.ByteOrder
+	switch order {
+	case 'B':
+		byteOrder = binary.BigEndian
+	case 'l':
+		byteOrder = binary.LittleEndian
+	default:
+		return nil, trace.BadParameter("unsupported X11 byte order marker %q", order)
+	}
+
+	nameLen := int(byteOrder.Uint16(data[6:8]))
+	dataLen := int(byteOrder.Uint16(data[8:10]))
+
+	namePadded := pad4(nameLen)
+	dataPadded := pad4(dataLen)
+	total := x11InitHeaderLen + namePadded + dataPadded
+	if len(data) < total {
+		return nil, trace.BadParameter("X11 init message truncated: need %v bytes, have %v", total, len(data))
+	}
+
+	name := string(data[x11InitHeaderLen : x11InitHeaderLen+nameLen])
+	authStart := x11InitHeaderLen + namePadded
+	auth := make([]byte, dataLen)
+	copy(auth, data[authStart:authStart+dataLen])
+
+	return &x11InitMessage{
+		byteOrder:    order,
+		protocolName: name,
+		authData:     auth,
+		headerLen:    total,
+	}, nil
+}
+
+// pad4 rounds n up to the next multiple of 4, per the X11 wire protocol's
+// padding rule for the protocol-name and authorization-data fields.
+func pad4(n int) int {
+	if n%4 == 0 {
+		return n
+	}
+	return n + (4 - n%4)
+}
+
+// rewriteX11AuthData rebuilds raw (the original bytes parsed into msg) with
+// msg's authorization data replaced by newAuthData, which must be the same
+// length as msg.authData. It is used to substitute the real client cookie
+// for the fake one the node handed out, without altering anything else in
+// the packet.
+func rewriteX11AuthData(raw []byte, msg *x11InitMessage, newAuthData []byte) ([]byte, error) {
+	if len(newAuthData) != len(msg.authData) {
+		return nil, trace.BadParameter(
+			"cannot substitute X11 auth data of length %v for data of length %v", len(newAuthData), len(msg.authData))
+	}
+
+	nameLen := len(msg.protocolName)
+	authStart := x11InitHeaderLen + pad4(nameLen)
+
+	out := make([]byte, len(raw))
+	copy(out, raw)
+	copy(out[authStart:authStart+len(newAuthData)], newAuthData)
+	return out, nil
+}
+
+// verifyAndSubstituteFakeX11Cookie checks that the X11 client connection
+// setup packet in raw authenticates with fakeCookie using the
+// MIT-MAGIC-COOKIE-1 protocol, and if so, returns a copy of raw with
+// fakeCookie replaced by realCookie. It returns an error if the packet
+// doesn't parse, uses a different authorization protocol, or doesn't
+// present fakeCookie -- which proves that only the process the node itself
+// authorized (by handing it fakeCookie via Xauthority) can use the
+// forwarded display.
+func verifyAndSubstituteFakeX11Cookie(raw []byte, fakeCookie, realCookie []byte) ([]byte, error) {
+	msg, err := parseX11InitMessage(raw)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if msg.protocolName != mitMagicCookieProtocol {
+		return nil, trace.AccessDenied("unsupported X11 authorization protocol %q", msg.protocolName)
+	}
+
+	if len(msg.authData) != len(fakeCookie) || subtle.ConstantTimeCompare(msg.authData, fakeCookie) != 1 {
+		return nil, trace.AccessDenied("X11 channel did not present the expected fake cookie")
+	}
+
+	return rewriteX11AuthData(raw, msg, realCookie)
+}
+
+// x11CookieRewriter wraps an io.Reader representing a freshly opened X11
+// channel, rewriting the leading connection-setup packet's authorization
+// cookie exactly once before passing all further reads through unmodified.
+type x11CookieRewriter struct {
+	src        io.Reader
+	fakeCookie []byte
+	realCookie []byte
+	rewritten  bool
+	buf        *bytes.Reader
+}
+
+// newX11CookieRewriter returns an io.Reader that, on first use, verifies the
+// channel's initial X11 connection setup packet carries fakeCookie and
+// splices in realCookie before forwarding the rest of src unchanged.
+func newX11CookieRewriter(src io.Reader, fakeCookie, realCookie []byte) io.Reader {
+	return &x11CookieRewriter{src: src, fakeCookie: fakeCookie, realCookie: realCookie}
+}
+
+func (r *x11CookieRewriter) Read(p []byte) (int, error) {
+	if r.rewritten {
+		if r.buf != nil && r.buf.Len() > 0 {
+			return r.buf.Read(p)
+		}
+		return r.src.Read(p)
+	}
+
+	raw, err := readX11InitPacket(r.src)
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	rewritten, err := verifyAndSubstituteFakeX11Cookie(raw, r.fakeCookie, r.realCookie)
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+
+	r.rewritten = true
+	r.buf = bytes.NewReader(rewritten)
+	return r.buf.Read(p)
+}
+
+// readX11InitPacket reads one complete X11 connection setup packet (the
+// fixed header plus the protocol name and authorization data it declares,
+// including their padding) from r, per the X Window System protocol
+// connection setup.
+func readX11InitPacket(r io.Reader) ([]byte, error) {
+	// The header is a fixed 12 bytes; read it first to learn how much more
+	// of the setup packet follows.
+	head := make([]byte, x11InitHeaderLen)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, trace.Wrap(err, "reading X11 init header")
+	}
+
+	var byteOrder binary.ByteOrder
+	switch head[0] {
+	case 'B':
+		byteOrder = binary.BigEndian
+	case 'l':
+		byteOrder = binary.LittleEndian
+	default:
+		return nil, trace.BadParameter("unsupported X11 byte order marker %q", head[0])
+	}
+	nameLen := int(byteOrder.Uint16(head[6:8]))
+	dataLen := int(byteOrder.Uint16(head[8:10]))
+	rest := make([]byte, pad4(nameLen)+pad4(dataLen))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, trace.Wrap(err, "reading X11 init body")
+	}
+
+	return append(head, rest...), nil
+}
+
+// hexCookie returns cookie hex-encoded, the form used on the wire in the
+// x11-req "x11-authentication-cookie" field and in Xauthority files.
+func hexCookie(cookie []byte) string {
+	return hex.EncodeToString(cookie)
+}
+
+// decodeHexCookie decodes a hex-encoded cookie as received in an x11-req
+// request back into raw bytes.
+func decodeHexCookie(s string) ([]byte, error) {
+	cookie, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, trace.Wrap(err, "decoding X11 authentication cookie")
+	}
+	return cookie, nil
+}
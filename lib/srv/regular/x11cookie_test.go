@@ -0,0 +1,150 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// buildX11InitPacket constructs a synthetic X11 client connection setup
+// packet carrying the MIT-MAGIC-COOKIE-1 protocol and the given cookie,
+// followed by trailer bytes representing the rest of the stream.
+func buildX11InitPacket(t *testing.T, cookie []byte, trailer []byte) []byte {
+	name := []byte(mitMagicCookieProtocol)
+	namePadded := pad4(len(name))
+	dataPadded := pad4(len(cookie))
+
+	buf := make([]byte, x11InitHeaderLen+namePadded+dataPadded)
+	buf[0] = 'B'
+	binary.BigEndian.PutUint16(buf[6:8], uint16(len(name)))
+	binary.BigEndian.PutUint16(buf[8:10], uint16(len(cookie)))
+	copy(buf[x11InitHeaderLen:], name)
+	copy(buf[x11InitHeaderLen+namePadded:], cookie)
+
+	return append(buf, trailer...)
+}
+
+func TestVerifyAndSubstituteFakeX11Cookie(t *testing.T) {
+	t.Parallel()
+
+	fakeCookie := bytesOfLen(16, 0xAA)
+	realCookie := bytesOfLen(16, 0xBB)
+
+	t.Run("valid fake cookie is substituted", func(t *testing.T) {
+		packet := buildX11InitPacket(t, fakeCookie, nil)
+		rewritten, err := verifyAndSubstituteFakeX11Cookie(packet, fakeCookie, realCookie)
+		require.NoError(t, err)
+
+		msg, err := parseX11InitMessage(rewritten)
+		require.NoError(t, err)
+		require.Equal(t, realCookie, msg.authData)
+	})
+
+	t.Run("wrong cookie is rejected", func(t *testing.T) {
+		packet := buildX11InitPacket(t, realCookie, nil)
+		_, err := verifyAndSubstituteFakeX11Cookie(packet, fakeCookie, realCookie)
+		require.Error(t, err)
+	})
+
+	t.Run("wrong protocol is rejected", func(t *testing.T) {
+		packet := buildX11InitPacket(t, fakeCookie, nil)
+		// Corrupt the protocol name length so it no longer reads as
+		// MIT-MAGIC-COOKIE-1.
+		packet[7] = 0
+		_, err := verifyAndSubstituteFakeX11Cookie(packet, fakeCookie, realCookie)
+		require.Error(t, err)
+	})
+}
+
+// TestX11CookieRewriterSplicesChannel verifies that newX11CookieRewriter
+// transparently swaps the fake cookie for the real one on the initial
+// packet and then passes the remainder of the stream through byte-for-byte,
+// simulating the node splicing a local X11 client's connection to the
+// forwarded channel.
+func TestX11CookieRewriterSplicesChannel(t *testing.T) {
+	t.Parallel()
+
+	fakeCookie := bytesOfLen(16, 0xAA)
+	realCookie := bytesOfLen(16, 0xBB)
+	trailer := []byte("subsequent X11 protocol traffic")
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		packet := buildX11InitPacket(t, fakeCookie, trailer)
+		clientConn.Write(packet)
+	}()
+
+	rewriter := newX11CookieRewriter(serverConn, fakeCookie, realCookie)
+
+	full := make([]byte, x11InitHeaderLen+pad4(len(mitMagicCookieProtocol))+pad4(len(realCookie))+len(trailer))
+	_, err := io.ReadFull(rewriter, full)
+	require.NoError(t, err)
+
+	msg, err := parseX11InitMessage(full)
+	require.NoError(t, err)
+	require.Equal(t, realCookie, msg.authData)
+	require.Equal(t, trailer, full[msg.headerLen:])
+}
+
+// TestX11CookieRewriterRejectsWrongCookie verifies that a channel whose
+// initial packet doesn't carry the fake cookie is rejected, proving an
+// unauthorized local process cannot hijack the forwarded display.
+func TestX11CookieRewriterRejectsWrongCookie(t *testing.T) {
+	t.Parallel()
+
+	fakeCookie := bytesOfLen(16, 0xAA)
+	realCookie := bytesOfLen(16, 0xBB)
+	wrongCookie := bytesOfLen(16, 0xCC)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		packet := buildX11InitPacket(t, wrongCookie, nil)
+		clientConn.Write(packet)
+	}()
+
+	rewriter := newX11CookieRewriter(serverConn, fakeCookie, realCookie)
+	buf := make([]byte, 64)
+	_, err := rewriter.Read(buf)
+	require.Error(t, err)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+}
+
+func bytesOfLen(n int, b byte) []byte {
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = b
+	}
+	return out
+}
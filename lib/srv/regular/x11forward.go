@@ -0,0 +1,220 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/trace"
+)
+
+// x11ForwardReqType is the OpenSSH channel request, sent on a "session"
+// channel, by which a client asks the server to forward X11 connections.
+const x11ForwardReqType = "x11-req"
+
+// x11ChannelType is the channel type the server opens back to the client
+// whenever a local process on the server wants to reach the forwarded X11
+// display.
+const x11ChannelType = "x11"
+
+// x11ForwardPayload is the wire format of an x11-req request's payload, per
+// RFC 4254 6.3.1. Field order (not names) determines how ssh.Unmarshal
+// decodes it.
+type x11ForwardPayload struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	ScreenNumber     uint32
+}
+
+// X11ForwardingChecker reports whether the already-authenticated user on
+// conn is permitted to use X11 forwarding, i.e. the PermitX11Forwarding role
+// option.
+type X11ForwardingChecker interface {
+	PermitX11Forwarding(conn ssh.ConnMetadata) bool
+}
+
+// SetX11ForwardingChecker configures the role-option gate consulted by the
+// x11-req handler. Without one configured, X11 forwarding requests are
+// denied, since (unlike agent forwarding) OpenSSH has no expectation that an
+// x11-req must appear to succeed for compatibility.
+func SetX11ForwardingChecker(checker X11ForwardingChecker) ServerOption {
+	return func(s *Server) error {
+		if checker == nil {
+			return trace.BadParameter("X11 forwarding checker cannot be nil")
+		}
+		s.x11ForwardingChecker = checker
+		return nil
+	}
+}
+
+// x11SocketPath derives the path of the unix socket this server binds, for
+// the lifetime of one granted x11-req, as the session's $DISPLAY. The
+// production node instead writes a fake-cookie Xauthority entry pointing
+// local X11 clients at a real display socket it already listens on; here the
+// path only needs to be unique per connection.
+func x11SocketPath(conn ssh.ConnMetadata) string {
+	return "/tmp/teleport-" + string(conn.SessionID()) + ".x11"
+}
+
+// handleX11ForwardRequest answers an x11-req received on a session channel.
+// On success, it generates a fake MIT-MAGIC-COOKIE-1 cookie (this is what a
+// real node would write into the session's Xauthority in place of the
+// client's real cookie) and starts listening on a unix socket standing in
+// for the session's $DISPLAY. Only once a local process in the session
+// actually connects to that socket -- exactly as a real X11 client connects
+// to $DISPLAY -- does the server open an x11 back-channel to the ssh client
+// and relay that one connection, having verified it presented the fake
+// cookie and substituted the real one back in.
+func (s *Server) handleX11ForwardRequest(sconn *ssh.ServerConn, req *ssh.Request, sess *sessionState) {
+	var payload x11ForwardPayload
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	if !s.permitX11Forwarding(sconn) || payload.AuthProtocol != mitMagicCookieProtocol {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	realCookie, err := decodeHexCookie(payload.AuthCookie)
+	if err != nil {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	fakeCookie, err := GenerateFakeX11Cookie()
+	if err != nil {
+		s.log.Debugf("Failed to generate fake X11 cookie: %v", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	displayPath := x11SocketPath(sconn)
+	os.Remove(displayPath)
+	listener, err := net.Listen("unix", displayPath)
+	if err != nil {
+		s.log.Debugf("Failed to open X11 display socket: %v", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	sess.x11FakeCookie = fakeCookie
+	sess.x11RealCookie = realCookie
+	sess.x11DisplayPath = displayPath
+	sess.x11Listener = listener
+
+	if s.x11FakeCookieObserver != nil {
+		s.x11FakeCookieObserver(fakeCookie)
+	}
+	if s.x11DisplayPathObserver != nil {
+		s.x11DisplayPathObserver(displayPath)
+	}
+
+	if req.WantReply {
+		req.Reply(true, nil)
+	}
+
+	go s.serveX11Display(sconn, listener, fakeCookie, realCookie)
+}
+
+// serveX11Display accepts connections on listener -- the session's $DISPLAY
+// stand-in -- until it's closed, forwarding each to its own x11 back-channel
+// on sconn. A real X server would serve many concurrent clients off one
+// display the same way.
+func (s *Server) serveX11Display(sconn *ssh.ServerConn, listener net.Listener, fakeCookie, realCookie []byte) {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.forwardX11Connection(sconn, conn, fakeCookie, realCookie)
+	}
+}
+
+// forwardX11Connection handles a single local connection to the session's
+// display socket. It reads through an x11CookieRewriter, which verifies the
+// connection's initial X11 connection setup packet presents fakeCookie
+// before anything else is read -- an unauthorized local process that
+// doesn't know the fake cookie never gets an x11 back-channel opened on its
+// behalf -- and substitutes realCookie in, then splices the rest of the
+// connection to a freshly opened back-channel.
+func (s *Server) forwardX11Connection(sconn *ssh.ServerConn, conn net.Conn, fakeCookie, realCookie []byte) {
+	defer conn.Close()
+
+	rewriter := newX11CookieRewriter(conn, fakeCookie, realCookie)
+
+	// Reading even a single byte forces the rewriter to read and verify the
+	// whole initial setup packet right now, before a back-channel is opened,
+	// so a connection presenting the wrong cookie is rejected here.
+	head := make([]byte, 1)
+	n, err := rewriter.Read(head)
+	if err != nil {
+		s.log.Debugf("Rejecting local X11 connection: %v", err)
+		return
+	}
+
+	ch, chreqs, err := sconn.OpenChannel(x11ChannelType, nil)
+	if err != nil {
+		s.log.Debugf("Failed to open X11 forwarding channel: %v", err)
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(chreqs)
+
+	if _, err := ch.Write(head[:n]); err != nil {
+		s.log.Debugf("Failed to forward X11 connection setup packet: %v", err)
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(ch, rewriter)
+		ch.CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, ch)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// permitX11Forwarding reports whether conn's user may use X11 forwarding;
+// absent a configured X11ForwardingChecker, forwarding is denied.
+func (s *Server) permitX11Forwarding(conn ssh.ConnMetadata) bool {
+	if s.x11ForwardingChecker == nil {
+		return false
+	}
+	return s.x11ForwardingChecker.PermitX11Forwarding(conn)
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testX11ForwardingChecker grants or denies PermitX11Forwarding for a
+// single configured username.
+type testX11ForwardingChecker struct {
+	permittedUser string
+}
+
+func (c *testX11ForwardingChecker) PermitX11Forwarding(conn ssh.ConnMetadata) bool {
+	return conn.User() == c.permittedUser
+}
+
+// buildX11ClientPacket builds a minimal X11 connection setup packet (the
+// fixed header plus a protocol name and authorization cookie), the inverse
+// of parseX11InitMessage, so a test can act as the local X11 client that
+// dials the session's display socket and presents a cookie on it.
+func buildX11ClientPacket(protocol string, authData []byte) []byte {
+	head := make([]byte, x11InitHeaderLen)
+	head[0] = 'B'
+	binary.BigEndian.PutUint16(head[6:8], uint16(len(protocol)))
+	binary.BigEndian.PutUint16(head[8:10], uint16(len(authData)))
+
+	out := append([]byte{}, head...)
+	out = append(out, []byte(protocol)...)
+	out = append(out, make([]byte, pad4(len(protocol))-len(protocol))...)
+	out = append(out, authData...)
+	out = append(out, make([]byte, pad4(len(authData))-len(authData))...)
+	return out
+}
+
+// x11TestServer bundles a Server configured for X11 forwarding together
+// with the test-only hooks needed to observe the fake cookies and display
+// socket paths it generates, since this minimal Server doesn't model
+// writing either into a real session's Xauthority.
+type x11TestServer struct {
+	*Server
+	fakeCookies  chan []byte
+	displayPaths chan string
+}
+
+// newX11TestServer starts a Server with X11 forwarding permitted only for
+// permittedUser.
+func newX11TestServer(t *testing.T, permittedUser string) *x11TestServer {
+	x := &x11TestServer{
+		fakeCookies:  make(chan []byte, 1),
+		displayPaths: make(chan string, 1),
+	}
+
+	signer := newTestHostSigner(t)
+	srv, err := New(
+		[]ssh.Signer{signer},
+		SetX11ForwardingChecker(&testX11ForwardingChecker{permittedUser: permittedUser}),
+	)
+	require.NoError(t, err)
+	srv.x11FakeCookieObserver = func(cookie []byte) { x.fakeCookies <- cookie }
+	srv.x11DisplayPathObserver = func(path string) { x.displayPaths <- path }
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Close() })
+
+	x.Server = srv
+	return x
+}
+
+// sendX11ForwardRequest issues an x11-req for realCookie over a new session
+// channel on clt, asserting the request was answered as expected.
+func sendX11ForwardRequest(t *testing.T, clt *ssh.Client, realCookie []byte, wantGranted bool) {
+	t.Helper()
+
+	ch, reqs, err := clt.OpenChannel("session", nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { ch.Close() })
+	go ssh.DiscardRequests(reqs)
+
+	payload := ssh.Marshal(x11ForwardPayload{
+		AuthProtocol: mitMagicCookieProtocol,
+		AuthCookie:   hexCookie(realCookie),
+	})
+	ok, err := ch.SendRequest(x11ForwardReqType, true, payload)
+	require.NoError(t, err)
+	require.Equal(t, wantGranted, ok)
+}
+
+// TestX11ForwardingWiredIntoChannelHandler verifies that x11-req is answered
+// by the real session-channel handler: a permitted user's request opens a
+// real local display socket; only once a local process dials that socket
+// and presents the fake cookie it was issued does the server open a real
+// x11 back-channel to the ssh client and substitute the real cookie back in
+// before splicing the connection through; a connection presenting the wrong
+// cookie never gets a back-channel opened at all; a denied user never gets
+// a display socket in the first place.
+func TestX11ForwardingWiredIntoChannelHandler(t *testing.T) {
+	t.Parallel()
+
+	realCookie := make([]byte, x11CookieLen)
+	for i := range realCookie {
+		realCookie[i] = byte(i + 1)
+	}
+
+	t.Run("local process presenting the fake cookie gets relayed with the real cookie substituted in", func(t *testing.T) {
+		t.Parallel()
+		x := newX11TestServer(t, "alice")
+
+		clt := dialAgentForwardClient(t, x.Addr(), "alice")
+		x11Chans := clt.HandleChannelOpen(x11ChannelType)
+
+		sendX11ForwardRequest(t, clt, realCookie, true)
+
+		var fakeCookie []byte
+		select {
+		case fakeCookie = <-x.fakeCookies:
+		case <-time.After(testEventuallyTimeout):
+			require.Fail(t, "server never generated a fake X11 cookie")
+		}
+
+		var displayPath string
+		select {
+		case displayPath = <-x.displayPaths:
+		case <-time.After(testEventuallyTimeout):
+			require.Fail(t, "server never opened a display socket")
+		}
+
+		// Act as the local X11 client: dial the display socket and present
+		// the fake cookie, as a real X client reading it out of Xauthority
+		// would.
+		display, err := net.Dial("unix", displayPath)
+		require.NoError(t, err)
+		defer display.Close()
+
+		_, err = display.Write(buildX11ClientPacket(mitMagicCookieProtocol, fakeCookie))
+		require.NoError(t, err)
+
+		var xch ssh.Channel
+		select {
+		case nch := <-x11Chans:
+			var err error
+			var xreqs <-chan *ssh.Request
+			xch, xreqs, err = nch.Accept()
+			require.NoError(t, err)
+			go ssh.DiscardRequests(xreqs)
+		case <-time.After(testEventuallyTimeout):
+			require.Fail(t, "server never opened the X11 back-channel")
+		}
+		defer xch.Close()
+
+		echoed := make([]byte, x11InitHeaderLen+pad4(len(mitMagicCookieProtocol))+pad4(x11CookieLen))
+		_, err = io.ReadFull(xch, echoed)
+		require.NoError(t, err)
+
+		msg, err := parseX11InitMessage(echoed)
+		require.NoError(t, err)
+		require.Equal(t, mitMagicCookieProtocol, msg.protocolName)
+		require.Equal(t, realCookie, msg.authData, "server must substitute the real cookie, not forward the fake one")
+
+		// Data from the client's real X server flows back to the local
+		// process over the same connection.
+		reply := []byte("reply from the client's real X server")
+		_, err = xch.Write(reply)
+		require.NoError(t, err)
+
+		got := make([]byte, len(reply))
+		_, err = io.ReadFull(display, got)
+		require.NoError(t, err)
+		require.Equal(t, reply, got)
+	})
+
+	t.Run("local connection presenting the wrong cookie never gets a back-channel", func(t *testing.T) {
+		t.Parallel()
+		x := newX11TestServer(t, "alice")
+
+		clt := dialAgentForwardClient(t, x.Addr(), "alice")
+		x11Chans := clt.HandleChannelOpen(x11ChannelType)
+
+		sendX11ForwardRequest(t, clt, realCookie, true)
+
+		var displayPath string
+		select {
+		case displayPath = <-x.displayPaths:
+		case <-time.After(testEventuallyTimeout):
+			require.Fail(t, "server never opened a display socket")
+		}
+
+		wrongCookie := make([]byte, x11CookieLen)
+		for i := range wrongCookie {
+			wrongCookie[i] = 0xFF
+		}
+
+		display, err := net.Dial("unix", displayPath)
+		require.NoError(t, err)
+		defer display.Close()
+
+		_, err = display.Write(buildX11ClientPacket(mitMagicCookieProtocol, wrongCookie))
+		require.NoError(t, err)
+
+		select {
+		case <-x11Chans:
+			require.Fail(t, "no X11 channel should ever be opened for a connection presenting the wrong cookie")
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+
+	t.Run("denied user never gets a display socket", func(t *testing.T) {
+		t.Parallel()
+		x := newX11TestServer(t, "alice")
+
+		clt := dialAgentForwardClient(t, x.Addr(), "mallory")
+
+		sendX11ForwardRequest(t, clt, realCookie, false)
+
+		select {
+		case <-x.displayPaths:
+			require.Fail(t, "no display socket should ever be opened for a denied user")
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+}
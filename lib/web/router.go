@@ -0,0 +1,69 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package web
+
+import (
+	"net/http"
+
+	"github.com/gravitational/trace"
+)
+
+// SessionResolver identifies the caller behind an already-authenticated web
+// request. The production Handler resolves this from the same signed
+// session cookie every other /v1/webapi route relies on; it's an interface
+// here so the router can be exercised without the full web session stack.
+type SessionResolver interface {
+	// ResolveIdentity returns the identityContext for r's session cookie, or
+	// an error if the request carries no valid session.
+	ResolveIdentity(r *http.Request) (identityContext, error)
+}
+
+// NewHandler builds the /v1/webapi routes this package owns. sessions
+// resolves the caller's identity from each request's session cookie;
+// issuer mints the certificate once that identity is known.
+func NewHandler(issuer sshCertIssuer, sessions SessionResolver) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/webapi/ssh/certs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ident, err := sessions.ResolveIdentity(r)
+		if err != nil {
+			writeError(w, trace.Wrap(err, "resolving session"))
+			return
+		}
+		if err := createSSHCert(issuer, ident, w, r); err != nil {
+			writeError(w, err)
+		}
+	})
+	return mux
+}
+
+// writeError renders err as a JSON-free, plain-text HTTP error, using
+// trace.AccessDenied/BadParameter to pick the status code the same way the
+// error is already categorized for other /v1/webapi routes.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case trace.IsBadParameter(err):
+		status = http.StatusBadRequest
+	case trace.IsAccessDenied(err):
+		status = http.StatusForbidden
+	}
+	http.Error(w, err.Error(), status)
+}
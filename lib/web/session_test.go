@@ -0,0 +1,79 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package web
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gravitational/trace"
+)
+
+// sessionCookieName is the cookie every /v1/webapi route's session
+// middleware looks for, matching the name used elsewhere in the proxy's web
+// server.
+const sessionCookieName = "__Host-session"
+
+// testUserIdentity is the concrete identityContext returned by
+// fakeSessionResolver.
+type testUserIdentity struct {
+	user string
+}
+
+func (i testUserIdentity) GetUser() string { return i.user }
+
+// fakeSessionResolver maps session cookie values to the user that created
+// them, with no signing, expiry, or auth-server validation whatsoever. It
+// exists only so tests can exercise NewHandler's SessionResolver dependency
+// without standing up a real web session; the production resolver validates
+// a signed, expiring session token against the auth server and must never be
+// replaced by this one.
+type fakeSessionResolver struct {
+	mu       sync.Mutex
+	sessions map[string]string
+}
+
+// newFakeSessionResolver creates an empty fakeSessionResolver.
+func newFakeSessionResolver() *fakeSessionResolver {
+	return &fakeSessionResolver{sessions: make(map[string]string)}
+}
+
+// createSession registers token as a valid session for user; a caller
+// presents token as the sessionCookieName cookie to authenticate as that
+// user.
+func (r *fakeSessionResolver) createSession(user, token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[token] = user
+}
+
+// ResolveIdentity implements SessionResolver.
+func (r *fakeSessionResolver) ResolveIdentity(req *http.Request) (identityContext, error) {
+	cookie, err := req.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, trace.AccessDenied("no session cookie present")
+	}
+
+	r.mu.Lock()
+	user, ok := r.sessions[cookie.Value]
+	r.mu.Unlock()
+	if !ok {
+		return nil, trace.AccessDenied("session is not valid")
+	}
+
+	return testUserIdentity{user: user}, nil
+}
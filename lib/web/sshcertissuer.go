@@ -0,0 +1,147 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package web
+
+import (
+	"crypto/rand"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/trace"
+)
+
+// roleRestrictions captures the subset of a user's role options this
+// stand-in CA enforces when minting a certificate: the OS logins the user
+// may request a certificate for, and which forwarding extensions to grant,
+// mirroring the PermitX11Forwarding/PermitAgentForwarding/
+// PermitPortForwarding role options the production auth server's RBAC
+// engine would otherwise evaluate.
+type roleRestrictions struct {
+	// Logins are the OS principals this user may request.
+	Logins []string
+	// PermitX11Forwarding, if true, grants the permit-X11-forwarding cert
+	// extension.
+	PermitX11Forwarding bool
+	// PermitAgentForwarding, if true, grants the permit-agent-forwarding
+	// cert extension.
+	PermitAgentForwarding bool
+	// PermitPortForwarding, if true, grants the permit-port-forwarding cert
+	// extension.
+	PermitPortForwarding bool
+}
+
+// userCA mints short-lived OpenSSH user certificates signed by a single CA
+// signer, enforcing each user's role restrictions and a maximum certificate
+// TTL. The production auth server instead delegates to the cluster's own CA
+// and RBAC engine; this is the minimal, self-contained stand-in that lets
+// the /v1/webapi/ssh/certs handler be exercised end-to-end.
+type userCA struct {
+	caSigner ssh.Signer
+	// roles maps a Teleport username to the role restrictions a certificate
+	// request for it must honor.
+	roles  map[string]roleRestrictions
+	maxTTL time.Duration
+}
+
+// newUserCA creates a userCA signing certificates with caSigner, capping
+// requested TTLs at maxTTL.
+func newUserCA(caSigner ssh.Signer, roles map[string]roleRestrictions, maxTTL time.Duration) *userCA {
+	return &userCA{
+		caSigner: caSigner,
+		roles:    roles,
+		maxTTL:   maxTTL,
+	}
+}
+
+// IssueUserCert implements sshCertIssuer.
+func (c *userCA) IssueUserCert(ctx identityContext, publicKey []byte, principals []string, ttl time.Duration) ([]byte, error) {
+	user := ctx.GetUser()
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(publicKey)
+	if err != nil {
+		return nil, trace.BadParameter("invalid public key: %v", err)
+	}
+
+	role, ok := c.roles[user]
+	if !ok {
+		return nil, trace.AccessDenied("user %q has no allowed logins", user)
+	}
+	grantedPrincipals := intersectPrincipals(principals, role.Logins)
+	if len(grantedPrincipals) == 0 {
+		return nil, trace.AccessDenied("none of the requested principals are allowed for user %q", user)
+	}
+
+	if ttl <= 0 || ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	extensions := map[string]string{"permit-pty": ""}
+	if role.PermitX11Forwarding {
+		extensions["permit-X11-forwarding"] = ""
+	}
+	if role.PermitAgentForwarding {
+		extensions["permit-agent-forwarding"] = ""
+	}
+	if role.PermitPortForwarding {
+		extensions["permit-port-forwarding"] = ""
+	}
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		KeyId:           user,
+		ValidPrincipals: grantedPrincipals,
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(ttl).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: extensions,
+		},
+	}
+	if err := cert.SignCert(rand.Reader, c.caSigner); err != nil {
+		return nil, trace.Wrap(err, "signing certificate")
+	}
+
+	return ssh.MarshalAuthorizedKey(cert), nil
+}
+
+// GetTrustedCAs implements sshCertIssuer. It returns the public key of the
+// CA that signs user certificates; this stand-in has no separate host CA.
+func (c *userCA) GetTrustedCAs(ctx identityContext) ([][]byte, error) {
+	return [][]byte{ssh.MarshalAuthorizedKey(c.caSigner.PublicKey())}, nil
+}
+
+// intersectPrincipals returns the elements of requested that also appear in
+// allowed, preserving requested's order. If requested is empty, every
+// allowed principal is granted.
+func intersectPrincipals(requested, allowed []string) []string {
+	if len(requested) == 0 {
+		return allowed
+	}
+	allowedSet := make(map[string]bool, len(allowed))
+	for _, login := range allowed {
+		allowedSet[login] = true
+	}
+	var granted []string
+	for _, login := range requested {
+		if allowedSet[login] {
+			granted = append(granted, login)
+		}
+	}
+	return granted
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// createSSHCertRequest is the body of a POST to /v1/webapi/ssh/certs. The
+// caller must already be authenticated (an existing web session cookie, as
+// with every other /v1/webapi route); this endpoint only mints a short-lived
+// OpenSSH certificate for that identity so tools like plain `ssh` can use it
+// via ssh-agent, without requiring a wrapped client binary.
+type createSSHCertRequest struct {
+	// PublicKey is the user-supplied OpenSSH public key to certify, in
+	// "ssh-ed25519 AAAA..." authorized_keys format.
+	PublicKey []byte `json:"public_key"`
+	// Principals is the list of OS logins the caller wants the certificate
+	// to carry. The final set is intersected with the caller's role-allowed
+	// logins by the auth server.
+	Principals []string `json:"principals,omitempty"`
+	// TTL is the requested certificate validity duration. The auth server
+	// caps this to the caller's role-defined maximum session TTL.
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+// createSSHCertResponse is the response to a successful certificate request.
+type createSSHCertResponse struct {
+	// Cert is the signed OpenSSH user certificate, authorized_keys format.
+	Cert []byte `json:"cert"`
+	// TrustedCAs are the CA public keys the issuer's GetTrustedCAs reports,
+	// in authorized_keys format.
+	TrustedCAs [][]byte `json:"trusted_cas"`
+}
+
+// sshCertIssuer is the subset of auth server functionality the handler
+// needs: minting a certificate for an already-authenticated identity,
+// honoring that identity's role restrictions (allowed logins, TTL cap,
+// PermitX11Forwarding, etc).
+type sshCertIssuer interface {
+	IssueUserCert(ctx identityContext, publicKey []byte, principals []string, ttl time.Duration) (cert []byte, err error)
+	GetTrustedCAs(ctx identityContext) ([][]byte, error)
+}
+
+// identityContext identifies the already-authenticated caller an SSH
+// certificate is being minted for; it's obtained from the same web session
+// middleware that guards every other /v1/webapi route (OIDC, SAML or local).
+type identityContext interface {
+	GetUser() string
+}
+
+// createSSHCert handles POST /v1/webapi/ssh/certs. The caller must present a
+// valid web session (enforced by the router's session middleware before
+// this handler runs); the handler itself is only responsible for validating
+// the request body and delegating to the auth server.
+func createSSHCert(issuer sshCertIssuer, ident identityContext, w http.ResponseWriter, r *http.Request) error {
+	var req createSSHCertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return trace.BadParameter("invalid request body: %v", err)
+	}
+	if len(req.PublicKey) == 0 {
+		return trace.BadParameter("public_key is required")
+	}
+
+	cert, err := issuer.IssueUserCert(ident, req.PublicKey, req.Principals, req.TTL)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	trustedCAs, err := issuer.GetTrustedCAs(ident)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	resp := createSSHCertResponse{
+		Cert:       cert,
+		TrustedCAs: trustedCAs,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return trace.Wrap(json.NewEncoder(w).Encode(resp))
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package web
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestSSHCertEndpointEndToEnd drives the full path a real ssh client relies
+// on: a POST to /v1/webapi/ssh/certs authenticated by a session cookie
+// yields a certificate, that certificate is loaded into a local ssh-agent
+// keyring, and a plain ssh.Dial using only that agent (no raw private key)
+// opens a session against a server whose CertChecker trusts the issuer's CA.
+func TestSSHCertEndpointEndToEnd(t *testing.T) {
+	t.Parallel()
+
+	caSigner := newTestHostSigner(t)
+	ca := newUserCA(caSigner, map[string]roleRestrictions{
+		"alice": {Logins: []string{"alice", "root"}, PermitX11Forwarding: true},
+	}, time.Hour)
+
+	sessions := newFakeSessionResolver()
+	sessions.createSession("alice", "test-token")
+
+	server := httptest.NewServer(NewHandler(ca, sessions))
+	defer server.Close()
+
+	_, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	clientSigner, err := ssh.NewSignerFromKey(clientPriv)
+	require.NoError(t, err)
+	authorizedKey := ssh.MarshalAuthorizedKey(clientSigner.PublicKey())
+
+	body, err := json.Marshal(createSSHCertRequest{
+		PublicKey:  authorizedKey,
+		Principals: []string{"alice"},
+		TTL:        time.Hour,
+	})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/webapi/ssh/certs", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "test-token"})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var certResp createSSHCertResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&certResp))
+
+	certPub, _, _, _, err := ssh.ParseAuthorizedKey(certResp.Cert)
+	require.NoError(t, err)
+	cert, ok := certPub.(*ssh.Certificate)
+	require.True(t, ok)
+	require.Equal(t, []string{"alice"}, cert.ValidPrincipals)
+	_, hasX11 := cert.Permissions.Extensions["permit-X11-forwarding"]
+	require.True(t, hasX11, "cert must carry permit-X11-forwarding for a role that permits it")
+	_, hasAgent := cert.Permissions.Extensions["permit-agent-forwarding"]
+	require.False(t, hasAgent, "cert must not carry permit-agent-forwarding for a role that doesn't permit it")
+
+	keyring := agent.NewKeyring()
+	require.NoError(t, keyring.Add(agent.AddedKey{
+		PrivateKey:  clientPriv,
+		Certificate: cert,
+	}))
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), caSigner.PublicKey().Marshal())
+		},
+	}
+
+	addr := startSSHServerTrustingCA(t, checker)
+
+	sshClient, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(keyring.Signers)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	require.NoError(t, err)
+	defer sshClient.Close()
+
+	sess, err := sshClient.NewSession()
+	require.NoError(t, err)
+	defer sess.Close()
+}
+
+// newTestHostSigner generates a throwaway ed25519 signer, standing in for
+// the cluster's user CA key in these tests.
+func newTestHostSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	return signer
+}
+
+// startSSHServerTrustingCA starts a minimal SSH server that authenticates
+// clients solely via checker, i.e. only a certificate signed by the trusted
+// CA (no raw public keys) is accepted -- proving the cert minted by the
+// endpoint is what actually authenticates the session, not the client's
+// underlying key on its own.
+func startSSHServerTrustingCA(t *testing.T, checker *ssh.CertChecker) string {
+	t.Helper()
+
+	hostSigner := newTestHostSigner(t)
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: checker.Authenticate,
+	}
+	cfg.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			nc, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sconn, chans, reqs, err := ssh.NewServerConn(nc, cfg)
+				if err != nil {
+					nc.Close()
+					return
+				}
+				defer sconn.Close()
+				go ssh.DiscardRequests(reqs)
+				for nch := range chans {
+					if nch.ChannelType() != "session" {
+						nch.Reject(ssh.UnknownChannelType, "unsupported channel type")
+						continue
+					}
+					ch, creqs, err := nch.Accept()
+					if err != nil {
+						continue
+					}
+					go ssh.DiscardRequests(creqs)
+					ch.Close()
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
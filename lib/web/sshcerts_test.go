@@ -0,0 +1,101 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeIdentity struct {
+	user string
+}
+
+func (f fakeIdentity) GetUser() string { return f.user }
+
+type fakeIssuer struct {
+	wantUser   string
+	cert       []byte
+	trustedCAs [][]byte
+	err        error
+}
+
+func (f *fakeIssuer) IssueUserCert(ctx identityContext, publicKey []byte, principals []string, ttl time.Duration) ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if ctx.GetUser() != f.wantUser {
+		return nil, trace.AccessDenied("unexpected user %v", ctx.GetUser())
+	}
+	return f.cert, nil
+}
+
+func (f *fakeIssuer) GetTrustedCAs(ctx identityContext) ([][]byte, error) {
+	return f.trustedCAs, nil
+}
+
+func TestCreateSSHCert(t *testing.T) {
+	t.Parallel()
+
+	issuer := &fakeIssuer{
+		wantUser:   "alice",
+		cert:       []byte("fake-cert"),
+		trustedCAs: [][]byte{[]byte("fake-ca")},
+	}
+	ident := fakeIdentity{user: "alice"}
+
+	body, err := json.Marshal(createSSHCertRequest{
+		PublicKey:  []byte("ssh-ed25519 AAAA alice@example.com"),
+		Principals: []string{"alice"},
+		TTL:        time.Hour,
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/webapi/ssh/certs", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	require.NoError(t, createSSHCert(issuer, ident, rec, req))
+
+	var resp createSSHCertResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Equal(t, issuer.cert, resp.Cert)
+	require.Equal(t, issuer.trustedCAs, resp.TrustedCAs)
+}
+
+func TestCreateSSHCertRequiresPublicKey(t *testing.T) {
+	t.Parallel()
+
+	issuer := &fakeIssuer{wantUser: "alice"}
+	ident := fakeIdentity{user: "alice"}
+
+	body, err := json.Marshal(createSSHCertRequest{})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/webapi/ssh/certs", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	err = createSSHCert(issuer, ident, rec, req)
+	require.Error(t, err)
+	require.True(t, trace.IsBadParameter(err))
+}